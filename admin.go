@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remove a device from Home Assistant with DELETE /devices/{topic}. Its
+// discovery config and retained messages are cleared and the bridge forgets
+// it. POST /devices/{topic}?rename={new topic} moves it to a new topic
+// instead. Devices announced under another discovery prefix are handled with
+// ?discovery_prefix=.
+func handleDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "DELETE, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices/"), "/")
+	if err := validateTopicLevel("topic", topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	discoveryPrefix := discovery_prefix
+	if value := r.URL.Query().Get("discovery_prefix"); value != "" {
+		discoveryPrefix = value
+	}
+	if !discoveryPrefixAllowed(discoveryPrefix) {
+		http.Error(w, fmt.Sprintf("discovery prefix %q is not allowed", discoveryPrefix), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		to := r.URL.Query().Get("rename")
+		if err := validateTopicLevel("rename", to); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if to == topic {
+			http.Error(w, "rename must differ from the topic", http.StatusBadRequest)
+			return
+		}
+		if err := migrateDevice(discoveryPrefix, topic, to); err != nil {
+			logRequest(r, ERROR, "Error renaming device", "topic", topic, "new_topic", to, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logRequest(r, INFO, "Renamed device", "topic", topic, "new_topic", to)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := removeDevice(discoveryPrefix, topic); err != nil {
+		logRequest(r, ERROR, "Error removing device", "topic", topic, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logRequest(r, INFO, "Removed device", "topic", topic)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Publish an empty discovery config for a device so Home Assistant removes
+// it, clear its retained messages and drop it from the caches
+func removeDevice(discoveryPrefix string, topic string) error {
+	discoveryTopic := deviceDiscoveryTopic(discoveryPrefix, topic)
+
+	unlock := deviceLocks.lock(discoveryTopic)
+	defer unlock()
+
+	mu.Lock()
+	cached, known := discoveryMessages[discoveryTopic]
+	mu.Unlock()
+
+	// Clear every discovery topic the device was announced on
+	configTopics := []string{discoveryTopic}
+	if known {
+		messages, err := discoveryMessagesFor(discoveryTopic, cached)
+		if err != nil {
+			return err
+		}
+		configTopics = configTopics[:0]
+		for topic := range messages {
+			configTopics = append(configTopics, topic)
+		}
+	}
+	for _, topic := range configTopics {
+		if err := publishDiscovery(context.Background(), topic, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	mu.Lock()
+	uncacheDiscovery(discoveryTopic)
+	mu.Unlock()
+	saveDiscoveryCache()
+
+	if err := clearFlatTopic(cached.StateTopic, topic); err != nil {
+		return err
+	}
+
+	// The state topic is only known for devices in the cache
+	if !known {
+		return nil
+	}
+	return clearDeviceState(cached.StateTopic)
+}
+
+// Clear the retained availability and state messages of a device's state
+// topic and forget its state
+func clearDeviceState(fullTopic string) error {
+	forgetState(fullTopic)
+	forgetDevice(fullTopic)
+	updateMeeting(fullTopic, false)
+
+	retained := []string{deviceAvailabilityTopic(fullTopic)}
+	if stateRetain {
+		retained = append(retained, fullTopic, attributesTopic(fullTopic))
+		for _, key := range stateKeys {
+			retained = append(retained, fmt.Sprintf("%s/%s", fullTopic, key))
+		}
+	}
+	for _, topic := range retained {
+		if err := publish(topic, 0, true, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Timer restoring the log level after a temporary change, and the level it
+// restores
+var logLevelRevert *time.Timer
+var revertLevel slog.Level
+var logLevelRevertMu sync.Mutex
+
+// Get the log level with GET /admin/loglevel or change it with PUT, with the
+// level as the body or ?level=. With ?for= the previous level is restored
+// after that long, so DEBUG can be enabled to capture a failure without
+// restarting or forgetting to turn it off.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, logLevelNames[logLevel.Level()])
+		return
+	case http.MethodPut:
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("level")
+	if name == "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name = string(body)
+	}
+	level, err := parseLogLevel(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if value := r.URL.Query().Get("for"); value != "" {
+		if duration, err = time.ParseDuration(value); err != nil || duration <= 0 {
+			http.Error(w, fmt.Sprintf("invalid for: %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	changeLogLevel(level, duration)
+	logRequest(r, INFO, "Log level set", "level", logLevelNames[level])
+	fmt.Fprintln(w, logLevelNames[level])
+}
+
+// Change the log level, restoring the previous one after duration unless it's
+// zero. A change cancels a pending restore, a temporary one restores the
+// level from before the first temporary change.
+func changeLogLevel(level slog.Level, duration time.Duration) {
+	logLevelRevertMu.Lock()
+	defer logLevelRevertMu.Unlock()
+	previous := logLevel.Level()
+	if logLevelRevert != nil && logLevelRevert.Stop() {
+		previous = revertLevel
+	}
+	logLevelRevert = nil
+	setLogLevel(level)
+	if duration > 0 {
+		revertLevel = previous
+		logLevelRevert = time.AfterFunc(duration, func() {
+			setLogLevel(previous)
+			logMessage(INFO, "Log level restored", "level", logLevelNames[previous])
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Require a shared token on every request, either as an
+// "Authorization: Bearer <token>" header or a "token" query parameter since
+// MuteDeck can't set headers on its webhook
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			logRequest(r, WARN, "Unauthorized request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mutedeck2mqtt"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Paths served without a client certificate, for health probes that can't
+// present one
+var clientCertExempt = map[string]bool{"/healthz": true, "/readyz": true}
+
+// Require a client certificate verified against TLS_CLIENT_CA_FILE on every
+// path but the health probes. The TLS handshake already rejected
+// certificates that don't verify.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clientCertExempt[r.URL.Path] && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			logRequest(r, WARN, "Rejected request without a client certificate")
+			http.Error(w, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Require an HMAC-SHA256 signature of the request body in the given header.
+// The signature is hex encoded and may be prefixed with "sha256=".
+func requireSignature(secret string, header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Let the next handler read the body again
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(header), "sha256="))
+		if err != nil {
+			signature = nil
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			logRequest(r, WARN, "Invalid signature on request")
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Parse a comma separated list of CIDRs. Plain IP addresses are treated as a
+// single host.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Parse an IP address that may include a port
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// Check whether an IP address is inside any of the networks
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Only allow requests from clients inside one of the networks
+func allowCIDRs(nets []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := getClientIP(r)
+		if !containsIP(nets, parseIP(clientIP)) {
+			logRequest(r, WARN, "Rejected request from IP not in ALLOWED_CIDRS")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Protect an endpoint exposing the devices' data with the admin token and
+// the allowed networks, whichever are configured. With neither it's refused,
+// rather than open to anyone who can reach the bridge.
+func requireAdmin(token string, nets []*net.IPNet, next http.Handler) http.Handler {
+	if token == "" && nets == nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Forbidden, set ADMIN_TOKEN or ALLOWED_CIDRS to use this endpoint", http.StatusForbidden)
+		})
+	}
+	if token != "" {
+		next = requireToken(token, next)
+	}
+	if nets != nil {
+		next = allowCIDRs(nets, next)
+	}
+	return next
+}
+
+// Limit the size of request bodies so a client can't exhaust memory
+func limitBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			logRequest(r, WARN, "Rejected request with a body too large", "bytes", r.ContentLength)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Bodies without a Content-Length are cut off while reading
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+		next.ServeHTTP(w, r)
+	})
+}
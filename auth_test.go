@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A handler answering with the request body
+var echoBody = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.Copy(w, r.Body)
+})
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestRequireSignature(t *testing.T) {
+	body := `{"call":"active"}`
+	tests := []struct {
+		name      string
+		signature string
+		status    int
+	}{
+		{name: "valid signature", signature: sign("secret", body), status: http.StatusOK},
+		{name: "sha256= prefix", signature: "sha256=" + sign("secret", body), status: http.StatusOK},
+		{name: "other secret", signature: sign("other", body), status: http.StatusUnauthorized},
+		{name: "other body", signature: sign("secret", body+" "), status: http.StatusUnauthorized},
+		{name: "not hex", signature: "not-a-signature", status: http.StatusUnauthorized},
+		{name: "missing", status: http.StatusUnauthorized},
+	}
+	handler := requireSignature("secret", "X-Signature", echoBody)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			if tt.signature != "" {
+				r.Header.Set("X-Signature", tt.signature)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			// The next handler reads the same body
+			if tt.status == http.StatusOK && w.Body.String() != body {
+				t.Errorf("next handler read %q, want %q", w.Body.String(), body)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		list    string
+		nets    []string
+		invalid bool
+	}{
+		{list: "", nets: nil},
+		{list: "192.168.1.0/24", nets: []string{"192.168.1.0/24"}},
+		{list: " 10.0.0.0/8 , 192.168.1.5 ,", nets: []string{"10.0.0.0/8", "192.168.1.5/32"}},
+		{list: "fd00::1", nets: []string{"fd00::1/128"}},
+		{list: "192.168.1.0/33", invalid: true},
+		{list: "laptop", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			nets, err := parseCIDRs(tt.list)
+			if (err != nil) != tt.invalid {
+				t.Fatalf("got error %v, want invalid %v", err, tt.invalid)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			if !slices.Equal(got, tt.nets) {
+				t.Errorf("got %v, want %v", got, tt.nets)
+			}
+		})
+	}
+}
+
+func TestContainsIP(t *testing.T) {
+	nets, err := parseCIDRs("192.168.1.0/24,10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.20", true},
+		{"192.168.2.20", false},
+		{"10.0.0.5", true},
+		{"10.0.0.6", false},
+		{"::ffff:192.168.1.20", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := containsIP(nets, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("containsIP(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAllowCIDRs(t *testing.T) {
+	nets, err := parseCIDRs("192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote string
+		status int
+	}{
+		{"192.168.1.20:51234", http.StatusOK},
+		{"192.168.2.20:51234", http.StatusForbidden},
+		{"[fd00::1]:51234", http.StatusForbidden},
+	}
+	handler := allowCIDRs(nets, echoBody)
+	for _, tt := range tests {
+		t.Run(tt.remote, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/devices", nil)
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	nets, err := parseCIDRs("192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		token  string
+		nets   []*net.IPNet
+		remote string
+		auth   string
+		status int
+	}{
+		{name: "neither configured", remote: "192.168.1.20:51234", auth: "Bearer admin", status: http.StatusForbidden},
+		{name: "token", token: "admin", remote: "192.168.2.20:51234", auth: "Bearer admin", status: http.StatusOK},
+		{name: "wrong token", token: "admin", remote: "192.168.1.20:51234", auth: "Bearer guest", status: http.StatusUnauthorized},
+		{name: "network", nets: nets, remote: "192.168.1.20:51234", status: http.StatusOK},
+		{name: "outside the network", nets: nets, remote: "192.168.2.20:51234", status: http.StatusForbidden},
+		{name: "both needed", token: "admin", nets: nets, remote: "192.168.2.20:51234", auth: "Bearer admin", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/devices", nil)
+			r.RemoteAddr = tt.remote
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			requireAdmin(tt.token, tt.nets, echoBody).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	tests := []struct {
+		name   string
+		path   string
+		tls    *tls.ConnectionState
+		status int
+	}{
+		{name: "verified certificate", path: "/webhook/laptop", tls: verified, status: http.StatusOK},
+		{name: "no certificate", path: "/webhook/laptop", tls: &tls.ConnectionState{}, status: http.StatusUnauthorized},
+		{name: "admin endpoint without a certificate", path: "/state", tls: &tls.ConnectionState{}, status: http.StatusUnauthorized},
+		{name: "liveness probe", path: "/healthz", tls: &tls.ConnectionState{}, status: http.StatusOK},
+		{name: "readiness probe", path: "/readyz", tls: &tls.ConnectionState{}, status: http.StatusOK},
+	}
+	handler := requireClientCert(echoBody)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Announce per-device availability next to the bridge's own
+var deviceAvailability = false
+
+// Devices announced as online since the bridge started, by availability topic
+var onlineDevices = make(map[string]bool)
+var onlineDevicesMu sync.Mutex
+
+// Mark a device offline when it hasn't posted for this long, zero to never
+var deviceTTL time.Duration
+
+// Publish a state with every field unknown when a device goes offline
+var deviceTTLClearState = false
+
+// Timers marking silent devices offline, by availability topic
+var deviceTimers = make(map[string]*time.Timer)
+
+// Publish when each device last posted
+var lastSeen = false
+
+// Topic announcing whether a device is online
+func deviceAvailabilityTopic(fullTopic string) string {
+	return fmt.Sprintf("%s/availability", fullTopic)
+}
+
+// Announce a device as online unless it already is
+func markDeviceOnline(ctx context.Context, fullTopic string) error {
+	topic := deviceAvailabilityTopic(fullTopic)
+
+	onlineDevicesMu.Lock()
+	online := onlineDevices[topic]
+	onlineDevicesMu.Unlock()
+	if online {
+		return nil
+	}
+
+	if err := publishOrQueue(ctx, topic, 1, true, []byte("online")); err != nil {
+		return err
+	}
+	logMessage(DEBUG, "Device online", "topic", topic)
+
+	onlineDevicesMu.Lock()
+	onlineDevices[topic] = true
+	onlineDevicesMu.Unlock()
+	return nil
+}
+
+// Restart the countdown after which a device that stops posting is marked
+// offline
+func touchDevice(fullTopic string, omit map[string]bool) {
+	if deviceTTL <= 0 {
+		return
+	}
+	topic := deviceAvailabilityTopic(fullTopic)
+
+	onlineDevicesMu.Lock()
+	defer onlineDevicesMu.Unlock()
+
+	if timer, ok := deviceTimers[topic]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(deviceTTL, func() {
+		onlineDevicesMu.Lock()
+		if deviceTimers[topic] != timer {
+			// A newer webhook replaced this timer
+			onlineDevicesMu.Unlock()
+			return
+		}
+		delete(deviceTimers, topic)
+		onlineDevices[topic] = false
+		onlineDevicesMu.Unlock()
+
+		markDeviceOffline(fullTopic, omit)
+	})
+	deviceTimers[topic] = timer
+}
+
+// Announce a silent device as offline and optionally clear its state
+func markDeviceOffline(fullTopic string, omit map[string]bool) {
+	topic := deviceAvailabilityTopic(fullTopic)
+	if err := publish(topic, 1, true, []byte("offline")); err != nil {
+		logMessage(ERROR, "Error publishing device availability", "error", err)
+	} else {
+		logMessage(INFO, "No update within the device TTL, device offline", "topic", topic, "ttl", deviceTTL)
+	}
+
+	// The next state must be published even if it matches the last one
+	forgetState(fullTopic)
+	updateMeeting(fullTopic, false)
+	if err := clearFlatTopic(fullTopic, ""); err != nil {
+		logMessage(ERROR, "Error clearing flat topic", "topic", fullTopic, "error", err)
+	}
+	if !deviceTTLClearState {
+		return
+	}
+
+	state := MuteDeckState{Call: unknownValue, Control: unknownValue, Mute: unknownValue, Record: unknownValue, Share: unknownValue, Video: unknownValue, InMeeting: unknownValue, Omit: omit}
+	if stateFormat != "fields" {
+		jsonData, err := json.Marshal(state)
+		if err != nil {
+			logMessage(ERROR, "Error marshaling JSON data", "error", err)
+			return
+		}
+		if err := publish(fullTopic, 0, stateRetain, jsonData); err != nil {
+			logMessage(ERROR, "Error clearing state on MQTT topic", "error", err)
+			return
+		}
+	}
+	if stateFormat != "json" {
+		for _, key := range append(stateKeys, "in_meeting") {
+			if omit[key] {
+				continue
+			}
+			if err := publish(fmt.Sprintf("%s/%s", fullTopic, key), 0, stateRetain, []byte(unknownValue)); err != nil {
+				logMessage(ERROR, "Error clearing state on MQTT topic", "error", err)
+				return
+			}
+		}
+	}
+	logMessage(INFO, "Cleared state of offline device", "topic", fullTopic)
+}
+
+// Forget a removed device's availability and stop its countdown
+func forgetDevice(fullTopic string) {
+	topic := deviceAvailabilityTopic(fullTopic)
+
+	onlineDevicesMu.Lock()
+	defer onlineDevicesMu.Unlock()
+
+	if timer, ok := deviceTimers[topic]; ok {
+		timer.Stop()
+		delete(deviceTimers, topic)
+	}
+	delete(onlineDevices, topic)
+}
+
+// Publish the time a device last posted to <state topic>/last_seen
+func publishLastSeen(ctx context.Context, fullTopic string) error {
+	topic := fmt.Sprintf("%s/%s", fullTopic, lastSeenEntity.Topic)
+	return publishOrQueue(ctx, topic, 0, stateRetain, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
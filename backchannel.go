@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A command waiting to be picked up by a device
+type pendingCommand struct {
+	Topic   string `json:"topic"`
+	Key     string `json:"key"`
+	Command string `json:"command"`
+	Time    string `json:"time"`
+}
+
+// Commands waiting for a device that polls for them. notify is closed and
+// replaced whenever a command arrives.
+type commandMailbox struct {
+	commands []pendingCommand
+	notify   chan struct{}
+}
+
+// Mailboxes of the devices in COMMAND_POLLING, the only ones that may poll
+var mailboxes = make(map[string]*commandMailbox)
+var mailboxesMu sync.Mutex
+
+// Commands kept for a device that isn't polling, older ones are dropped
+const maxPendingCommands = 20
+
+// Longest a poll waits for a command
+var commandPollTimeout = 25 * time.Second
+
+// Callback URL of each device commands are posted to, by topic
+var commandCallbacks = make(map[string]string)
+var commandCallbacksMu sync.Mutex
+
+// Let webhooks register their device's callback URL with a callback
+// parameter or field, and the hosts those URLs may point to
+var callbackRegistration = false
+var callbackHosts = make(map[string]bool)
+
+// Set the devices that poll for their commands, from a comma separated list
+// of topics
+func setCommandPolling(list string) error {
+	mailboxesMu.Lock()
+	defer mailboxesMu.Unlock()
+	for _, topic := range strings.Split(list, ",") {
+		if topic = strings.TrimSpace(topic); topic == "" {
+			continue
+		}
+		if err := validateTopicLevel("topic", topic); err != nil {
+			return err
+		}
+		mailboxes[topic] = &commandMailbox{notify: make(chan struct{})}
+	}
+	return nil
+}
+
+// Check that a callback URL a webhook registers points to an allowed host,
+// so the bridge can't be made to post to any address its network reaches
+func validateRegisteredCallback(callback string) error {
+	if err := validateOutboundURL(callback); err != nil {
+		return err
+	}
+	u, _ := url.Parse(callback)
+	if !callbackHosts[strings.ToLower(u.Host)] && !callbackHosts[strings.ToLower(u.Hostname())] {
+		return fmt.Errorf("callback host %q is not allowed", u.Host)
+	}
+	return nil
+}
+
+// Parse a comma separated list of topic=URL callbacks
+func parseCommandCallbacks(list string) (map[string]string, error) {
+	callbacks := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		topic, callback, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected topic=URL, got %q", entry)
+		}
+		topic = strings.TrimSpace(topic)
+		if err := validateTopicLevel("topic", topic); err != nil {
+			return nil, err
+		}
+		if err := validateOutboundURL(strings.TrimSpace(callback)); err != nil {
+			return nil, err
+		}
+		callbacks[topic] = strings.TrimSpace(callback)
+	}
+	return callbacks, nil
+}
+
+// Register the callback URL of a device
+func registerCallback(topic string, callback string) {
+	commandCallbacksMu.Lock()
+	defer commandCallbacksMu.Unlock()
+	if commandCallbacks[topic] != callback {
+		logMessage(INFO, "Registered command callback", "topic", topic, "callback", callback)
+	}
+	commandCallbacks[topic] = callback
+}
+
+// Get the callback URL of a device, empty if it has none
+func callbackFor(topic string) string {
+	commandCallbacksMu.Lock()
+	defer commandCallbacksMu.Unlock()
+	return commandCallbacks[topic]
+}
+
+// Post a command to a device's callback URL
+func postCallback(callback string, command pendingCommand) error {
+	body, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	req, err := newOutboundRequest(http.MethodPost, callback, "application/json", body)
+	if err != nil {
+		return err
+	}
+	return sendOutbound(req, localTimeout, nil)
+}
+
+// Whether a device polls for its commands
+func pollingDevice(topic string) bool {
+	mailboxesMu.Lock()
+	defer mailboxesMu.Unlock()
+	_, ok := mailboxes[topic]
+	return ok
+}
+
+// Leave a command for a device that polls for it
+func queueCommand(command pendingCommand) {
+	mailboxesMu.Lock()
+	defer mailboxesMu.Unlock()
+	mailbox, ok := mailboxes[command.Topic]
+	if !ok {
+		return
+	}
+	mailbox.commands = append(mailbox.commands, command)
+	if len(mailbox.commands) > maxPendingCommands {
+		mailbox.commands = mailbox.commands[len(mailbox.commands)-maxPendingCommands:]
+	}
+	close(mailbox.notify)
+	mailbox.notify = make(chan struct{})
+}
+
+// Hand a device in COMMAND_POLLING its commands with GET /commands/{topic}.
+// The request waits up to ?wait= (25s at most) for a command to arrive and
+// answers 204 No Content if none does, so devices that can't be reached can
+// poll for them.
+func handleCommandPoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := strings.Trim(strings.TrimPrefix(r.URL.Path, "/commands/"), "/")
+	if err := validateTopicLevel("topic", topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait := commandPollTimeout
+	if value := r.URL.Query().Get("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("invalid wait: %q", value), http.StatusBadRequest)
+			return
+		}
+		if d < wait {
+			wait = d
+		}
+	}
+
+	mailboxesMu.Lock()
+	mailbox, ok := mailboxes[topic]
+	mailboxesMu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		mailboxesMu.Lock()
+		commands, notify := mailbox.commands, mailbox.notify
+		mailbox.commands = nil
+		mailboxesMu.Unlock()
+
+		if len(commands) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(commands)
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Announce the bridge itself as a Home Assistant device with its diagnostics
+var bridgeDiscovery = true
+
+// The bridge's discovery message once announced, resent with the devices'
+// when Home Assistant comes online
+var bridgeDiscoveryTopic string
+var bridgeDiscoveryPayload DiscoveryPayloadStruct
+var bridgeMu sync.Mutex
+
+// Entities of the bridge device. Except for the connection, which follows
+// the availability topic, they read the diagnostics.
+var bridgeEntities = []entity{
+	{Key: "connected", Name: "Connected", Icon: "mdi:lan-connect", Platform: "binary_sensor", DeviceClass: "connectivity"},
+	{Key: "uptime", Name: "Uptime", Icon: "mdi:timer-outline", Platform: "sensor", DeviceClass: "duration", Unit: "s"},
+	{Key: "version", Name: "Version", Icon: "mdi:tag", Platform: "sensor"},
+	{Key: "devices", Name: "Devices", Icon: "mdi:laptop", Platform: "sensor"},
+	{Key: "messages_published", Name: "Messages published", Icon: "mdi:message-arrow-right", Platform: "sensor"},
+	{Key: "last_error", Name: "Last error", Icon: "mdi:alert-circle-outline", Platform: "sensor"},
+	{Key: "recent_errors", Name: "Recent errors", Icon: "mdi:alert-circle-check-outline", Platform: "sensor"},
+}
+
+// Build the discovery message of the bridge device. Diagnostics older than a
+// few intervals expire so a stopped bridge doesn't show stale values.
+func buildBridgeDiscoveryPayload(stateTopic string, interval time.Duration) DiscoveryPayloadStruct {
+	components := make(map[string]Component, len(bridgeEntities))
+	for _, e := range bridgeEntities {
+		component := Component{
+			EnabledByDefault: true,
+			EntityCategory:   "diagnostic",
+			Icon:             e.Icon,
+			Name:             localizedName("bridge_"+e.Key, e.Name),
+			ObjectID:         fmt.Sprintf("mutedeck2mqtt_bridge_%s", e.Key),
+			Platform:         e.Platform,
+			StateTopic:       stateTopic,
+			UniqueID:         fmt.Sprintf("mutedeck2mqtt_bridge_%s", e.Key),
+			ValueTemplate:    e.valueTemplate(false),
+			ExpireAfter:      int((3 * interval).Seconds()),
+			DeviceClass:      e.DeviceClass,
+			Unit:             e.Unit,
+		}
+		if e.Key == "connected" {
+			component.StateTopic = availabilityTopic
+			component.ValueTemplate = "{{ value == 'online' and 'ON' or 'OFF' }}"
+			component.ExpireAfter = 0
+		}
+		if e.Key == "recent_errors" {
+			// The count is the state, the errors are its attributes
+			component.ValueTemplate = "{{ value_json.recent_errors | count }}"
+			component.JSONAttributesTopic = stateTopic
+			component.JSONAttributesTemplate = "{{ {'errors': value_json.recent_errors} | tojson }}"
+		}
+		components[component.ObjectID] = component
+	}
+
+	return DiscoveryPayloadStruct{
+		Device: Device{
+			IDs:             []string{"mutedeck2mqtt_bridge"},
+			Name:            "MuteDeck2MQTT",
+			Manufacturer:    "MuteDeck2MQTT",
+			SoftwareVersion: version,
+		},
+		Origin:     origin,
+		Components: components,
+		StateTopic: stateTopic,
+	}
+}
+
+// Announce the bridge device
+func announceBridge(stateTopic string, interval time.Duration) error {
+	topic := fmt.Sprintf("%s/device/mutedeck2mqtt_bridge/config", discovery_prefix)
+	payload := buildBridgeDiscoveryPayload(stateTopic, interval)
+	if err := clearOtherDiscoveryFormat(context.Background(), topic, payload); err != nil {
+		return err
+	}
+	messages, err := discoveryMessagesFor(topic, payload)
+	if err != nil {
+		return err
+	}
+	for configTopic, jsonData := range messages {
+		if err := publishDiscovery(context.Background(), configTopic, jsonData); err != nil {
+			return err
+		}
+		logMessage(INFO, "Discovery message sent", "topic", configTopic)
+		logMessage(DEBUG, "Discovery message body", "topic", configTopic, "payload", string(jsonData))
+	}
+
+	bridgeMu.Lock()
+	defer bridgeMu.Unlock()
+	bridgeDiscoveryTopic = topic
+	bridgeDiscoveryPayload = payload
+	return nil
+}
+
+// Get the bridge's discovery message by topic, empty if it wasn't announced
+func bridgeDiscoveryMessage() map[string]DiscoveryPayloadStruct {
+	bridgeMu.Lock()
+	defer bridgeMu.Unlock()
+	if bridgeDiscoveryTopic == "" {
+		return nil
+	}
+	return map[string]DiscoveryPayloadStruct{bridgeDiscoveryTopic: bridgeDiscoveryPayload}
+}
+
+// Topic the bridge takes administrative commands on, and whether it does
+var bridgeCommandTopic = "mutedeck2mqtt/bridge/cmd"
+var bridgeCommands = false
+
+// Handle an administrative command like "resend_discovery",
+// "clear_device laptop" or "set_log_level debug"
+func onBridgeCommand(client mqtt.Client, msg mqtt.Message) {
+	// Don't hold up the MQTT client while publishing
+	go func() {
+		defer recoverGoroutine("bridge command handler")
+		command := strings.TrimSpace(string(msg.Payload()))
+		if err := runBridgeCommand(client, command); err != nil {
+			logMessage(WARN, "Bridge command failed", "command", command, "error", err)
+			return
+		}
+		logMessage(INFO, "CMD", "topic", msg.Topic(), "payload", command)
+	}()
+}
+
+// Run an administrative command. Devices announced under another discovery
+// prefix are named by adding the prefix as the last argument.
+func runBridgeCommand(client mqtt.Client, command string) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return errors.New("empty command")
+	}
+
+	// The device commands take the discovery prefix as an optional last
+	// argument
+	discoveryPrefix := func(args []string, n int) (string, error) {
+		switch {
+		case len(args) == n:
+			return discovery_prefix, nil
+		case len(args) == n+1 && discoveryPrefixAllowed(args[n]):
+			return args[n], nil
+		case len(args) == n+1:
+			return "", fmt.Errorf("discovery prefix %q is not allowed", args[n])
+		}
+		return "", fmt.Errorf("expected %d arguments and an optional discovery prefix", n)
+	}
+
+	switch name, args := strings.ToLower(fields[0]), fields[1:]; name {
+	case "resend_discovery":
+		resendDiscoveryMessages(client)
+	case "clear_device":
+		prefix, err := discoveryPrefix(args, 1)
+		if err != nil {
+			return err
+		}
+		if err := validateTopicLevel("topic", args[0]); err != nil {
+			return err
+		}
+		return removeDevice(prefix, args[0])
+	case "rename_device":
+		prefix, err := discoveryPrefix(args, 2)
+		if err != nil {
+			return err
+		}
+		for _, topic := range args[:2] {
+			if err := validateTopicLevel("topic", topic); err != nil {
+				return err
+			}
+		}
+		if args[0] == args[1] {
+			return errors.New("the new topic must differ from the old one")
+		}
+		return migrateDevice(prefix, args[0], args[1])
+	case "set_log_level":
+		if len(args) != 1 {
+			return errors.New("expected a log level")
+		}
+		level, err := parseLogLevel(args[0])
+		if err != nil {
+			return err
+		}
+		changeLogLevel(level, 0)
+	default:
+		return fmt.Errorf("unknown command %q, expected resend_discovery, clear_device, rename_device or set_log_level", name)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A single MQTT connection and its connection state
+type broker struct {
+	name   string
+	client mqtt.Client
+
+	mu        sync.Mutex
+	connected bool
+	// Why the password couldn't be read for the current connection attempt
+	credentialsErr error
+}
+
+// All configured brokers, the primary broker is always first. Filled in
+// before any broker connects and only read afterwards, so it needs no lock.
+var brokers []*broker
+
+// Returned to webhooks while the primary broker is disconnected
+var errBrokerDisconnected = errors.New("not connected to the MQTT broker")
+
+// Topic announcing whether the bridge is online
+var availabilityTopic = "mutedeck2mqtt/bridge/availability"
+
+// Topics Home Assistant announces its status on and the payload it sends when
+// it comes online. By default there's one per discovery prefix.
+var homeAssistantStatusTopics []string
+var homeAssistantOnlinePayload = "online"
+
+// Returns the username and password to use for the next connection attempt,
+// or why the password couldn't be read
+type credentialsProvider func() (string, string, error)
+
+// Credentials that never change
+func staticCredentials(user string, pass string) credentialsProvider {
+	return func() (string, string, error) {
+		return user, pass, nil
+	}
+}
+
+// Re-read the password from a file on every connect
+func fileCredentials(user string, path string) credentialsProvider {
+	return func() (string, string, error) {
+		pass, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading MQTT password file: %w", err)
+		}
+		return user, strings.TrimSpace(string(pass)), nil
+	}
+}
+
+// Run a command on every connect and use its output as the password. The
+// command is run directly rather than through a shell, since the container
+// image doesn't ship one.
+func commandCredentials(user string, command string) credentialsProvider {
+	args := strings.Fields(command)
+	return func() (string, string, error) {
+		pass, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			return "", "", fmt.Errorf("error running MQTT password command: %w", err)
+		}
+		return user, strings.TrimSpace(string(pass)), nil
+	}
+}
+
+// Pick a credentials provider from the <prefix>_USER, <prefix>_PASS,
+// <prefix>_PASS_FILE and <prefix>_PASS_COMMAND environment variables.
+// A username without a password source is sent with an empty password, for
+// brokers that only check usernames. Returns nil if neither is configured.
+func credentialsFromEnv(prefix string) credentialsProvider {
+	user := os.Getenv(prefix + "_USER")
+	if command := os.Getenv(prefix + "_PASS_COMMAND"); strings.TrimSpace(command) != "" {
+		return commandCredentials(user, command)
+	}
+	if path := os.Getenv(prefix + "_PASS_FILE"); path != "" {
+		return fileCredentials(user, path)
+	}
+	if pass := os.Getenv(prefix + "_PASS"); pass != "" || user != "" {
+		return staticCredentials(user, pass)
+	}
+	return nil
+}
+
+// Whether <prefix>_PASS, <prefix>_PASS_FILE or <prefix>_PASS_COMMAND is set
+func passwordConfigured(prefix string) bool {
+	return os.Getenv(prefix+"_PASS") != "" || os.Getenv(prefix+"_PASS_FILE") != "" || strings.TrimSpace(os.Getenv(prefix+"_PASS_COMMAND")) != ""
+}
+
+// Build a broker connection with handlers that track its connection state.
+// With connectRetry set the initial connection is retried in the background.
+func newBroker(name string, host string, port int, clientID string, credentials credentialsProvider, connectRetry bool) *broker {
+	b := &broker{name: name}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", host, port))
+	opts.SetClientID(clientID)
+	if credentials != nil {
+		opts.SetCredentialsProvider(func() (string, string) {
+			user, pass, err := credentials()
+			b.mu.Lock()
+			b.credentialsErr = err
+			b.mu.Unlock()
+			if err != nil {
+				logMessage(ERROR, "Error getting MQTT credentials", "broker", name, "error", err)
+			}
+			return user, pass
+		})
+		// The credentials are read before the connection is opened, so a
+		// password that couldn't be read fails the attempt rather than
+		// connecting without it
+		opts.SetDialer(&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				return b.credentialsErr
+			},
+		})
+	}
+	opts.SetConnectRetry(connectRetry)
+	// Let the broker announce the bridge as offline if the connection drops
+	opts.SetWill(availabilityTopic, "offline", 1, true)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		defer recoverGoroutine("MQTT connect handler")
+		b.setConnected(true)
+		logMessage(INFO, "Connected to MQTT broker", "broker", b.name, "host", host)
+		client.Publish(availabilityTopic, 1, true, "online")
+		if b.name == "primary" {
+			// The broker is reachable again, let publishes through
+			publishCircuit.reset()
+			if offlineQueueFile != "" {
+				startOfflineReplay()
+			}
+		}
+
+		// Subscribe on every connect so the subscription survives reconnects
+		for _, topic := range homeAssistantStatusTopics {
+			client.Subscribe(topic, 0, recoverMessages("Home Assistant status handler", onHomeAssistantStatus))
+		}
+		if bridgeCommands {
+			client.Subscribe(bridgeCommandTopic, 0, recoverMessages("bridge command handler", onBridgeCommand))
+		}
+		client.Subscribe(commandTopicRoot+"/+/+", 0, recoverMessages("command handler", onCommand))
+		if simulate {
+			client.Subscribe(simulateTopic+"/+", 0, recoverMessages("simulate handler", onSimulate))
+		}
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		defer recoverGoroutine("MQTT connection lost handler")
+		b.setConnected(false)
+		stats.recordError(fmt.Errorf("lost connection to %s broker: %v", b.name, err))
+		recordRecentError("connection", "", fmt.Sprintf("lost connection to %s broker: %v", b.name, err))
+		logMessage(WARN, "Lost connection to MQTT broker", "broker", b.name, "error", err)
+	})
+
+	b.client = mqtt.NewClient(opts)
+	return b
+}
+
+func (b *broker) setConnected(connected bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connected = connected
+}
+
+func (b *broker) isConnected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connected
+}
+
+// How long to wait for a publish to complete, including the broker's
+// acknowledgement of QoS 1 messages
+var publishTimeout = 10 * time.Second
+
+// Publish a message to this broker and wait for it to complete
+func (b *broker) publish(topic string, qos byte, retained bool, payload []byte) error {
+	if !b.isConnected() {
+		return fmt.Errorf("%s broker is not connected", b.name)
+	}
+	token := b.client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("%s broker didn't acknowledge %s within %s", b.name, topic, publishTimeout)
+	}
+	return token.Error()
+}
+
+// Longest wait between attempts to make the primary broker's first
+// connection
+var mqttConnectMaxBackoff = time.Minute
+
+// Make a broker's first connection, retrying with a growing delay until it
+// succeeds. ready is closed once connected; later reconnects are handled by
+// the client.
+func connectWithRetry(b *broker, ready chan<- struct{}) {
+	retry(context.Background(), backoff{initial: time.Second, max: mqttConnectMaxBackoff, retries: -1}, "connecting to MQTT broker", func() error {
+		token := b.client.Connect()
+		token.Wait()
+		return token.Error()
+	}, "broker", b.name)
+	close(ready)
+}
+
+// Publish a message to every configured broker simultaneously. Only the
+// primary broker's error is returned, mirror failures are logged.
+func publish(topic string, qos byte, retained bool, payload []byte) error {
+	if len(brokers) == 0 {
+		return errBrokerDisconnected
+	}
+	if !publishCircuit.allow() {
+		return errCircuitOpen
+	}
+	errs := make([]error, len(brokers))
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i, b := range brokers {
+		wg.Add(1)
+		go func(i int, b *broker) {
+			defer wg.Done()
+			errs[i] = b.publish(topic, qos, retained, payload)
+		}(i, b)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		recordRecentError("publish", topic, err.Error())
+		if i > 0 {
+			logMessage(WARN, "Error publishing to MQTT broker", "broker", brokers[i].name, "topic", topic, "error", err)
+		}
+	}
+	publishCircuit.record(errs[0])
+	stats.recordPublish(errs[0])
+	statsdTiming("mqtt.publish.duration", time.Since(start))
+	if errs[0] != nil {
+		statsdCount("mqtt.publish_errors", 1)
+	} else {
+		statsdCount("mqtt.publishes", 1)
+	}
+	return errs[0]
+}
+
+// How often publishing a state is retried, and the delay before the first
+// retry, doubled for each one after it
+var publishRetries = 2
+var publishRetryBackoff = 500 * time.Millisecond
+
+// Publish a message once, giving up when ctx ends, and retry it in the
+// background with a growing delay if that fails so a momentary broker hiccup
+// doesn't lose it
+func publishWithRetry(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	return publishRetried(ctx, backoff{initial: publishRetryBackoff, retries: publishRetries}, topic, qos, retained, payload)
+}
+
+// Announce the bridge as offline and disconnect from every broker
+func disconnectBrokers() {
+	for _, b := range brokers {
+		if b.isConnected() {
+			if err := b.publish(availabilityTopic, 1, true, []byte("offline")); err != nil {
+				logMessage(WARN, "Error publishing offline availability to MQTT broker", "broker", b.name, "error", err)
+			}
+		}
+		b.client.Disconnect(250)
+		b.setConnected(false)
+		logMessage(INFO, "Disconnected from MQTT broker", "broker", b.name)
+	}
+}
+
+// Recover from a panic in an MQTT message handler, which would otherwise
+// crash the bridge from within the MQTT client
+func recoverMessages(name string, handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		defer recoverGoroutine(name)
+		handler(client, msg)
+	}
+}
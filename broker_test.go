@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	user, pass, err := fileCredentials("bridge", path)()
+	if user != "bridge" || pass != "secret" || err != nil {
+		t.Errorf("got %q, %q and error %v, want bridge, secret and no error", user, pass, err)
+	}
+	if _, pass, err := fileCredentials("bridge", path+".missing")(); err == nil || pass != "" {
+		t.Errorf("got password %q and error %v for a missing file, want an error", pass, err)
+	}
+}
+
+func TestConnectFailsWithoutReadablePassword(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	b := newBroker("primary", "127.0.0.1", addr.Port, "test-"+strconv.Itoa(addr.Port),
+		fileCredentials("bridge", filepath.Join(t.TempDir(), "missing")), false)
+	token := b.client.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatal("connect didn't finish")
+	}
+	if token.Error() == nil {
+		t.Error("connected without the password")
+	}
+	select {
+	case <-accepted:
+		t.Error("opened a connection to the broker without the password")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
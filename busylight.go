@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A light showing whether a topic's user is busy, either a WLED device's
+// URL or an ESPHome light's MQTT command topic
+type busyLight struct {
+	kind   string
+	target string
+}
+
+// Lights of each topic
+var busyLights = make(map[string][]busyLight)
+
+// Colors shown while free, in a call, and in a call with the microphone
+// muted, nil to turn the light off, and the brightness they're shown with
+var busyLightFree []byte
+var busyLightCall = []byte{0xff, 0x00, 0x00}
+var busyLightMuted = []byte{0xff, 0xa0, 0x00}
+var busyLightBrightness = 128
+
+// Color last queued for each light, so it's only sent again when it changes.
+// A light is missing until a color was queued, and again after sending one
+// failed.
+var busyLightColors = make(map[busyLight]string)
+var busyLightColorsMu sync.Mutex
+
+// Light updates queued per light so they're sent in order. A full queue
+// drops the new update, which is sent again with the next state.
+var busyLightQueue *deviceQueue
+
+// Parse a comma separated list of topic=wled:URL and topic=esphome:topic
+// lights. A topic may have several lights.
+func parseBusyLights(list string) (map[string][]busyLight, error) {
+	lights := make(map[string][]busyLight)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		topic, light, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected topic=wled:URL or topic=esphome:topic, got %q", entry)
+		}
+		topic = strings.TrimSpace(topic)
+		if err := validateTopicLevel("topic", topic); err != nil {
+			return nil, err
+		}
+		kind, target, _ := strings.Cut(strings.TrimSpace(light), ":")
+		switch kind {
+		case "wled":
+			if err := validateOutboundURL(target); err != nil {
+				return nil, err
+			}
+		case "esphome":
+			if target == "" || strings.ContainsAny(target, "+#") {
+				return nil, fmt.Errorf("invalid ESPHome command topic %q", target)
+			}
+		default:
+			return nil, fmt.Errorf("unknown light type %q, expected wled or esphome", kind)
+		}
+		lights[topic] = append(lights[topic], busyLight{kind: kind, target: target})
+	}
+	return lights, nil
+}
+
+// Parse a color as RRGGBB, or "off" for no color
+func parseBusyLightColor(value string) ([]byte, error) {
+	if strings.EqualFold(value, "off") {
+		return nil, nil
+	}
+	color, err := hex.DecodeString(strings.TrimPrefix(value, "#"))
+	if err != nil || len(color) != 3 {
+		return nil, fmt.Errorf("expected RRGGBB or off, got %q", value)
+	}
+	return color, nil
+}
+
+// Show a topic's state on its lights
+func updateBusyLights(topic string, state MuteDeckState) {
+	lights := busyLights[topic]
+	if len(lights) == 0 || state.Omit["call"] || state.Call == "" || state.Call == unknownValue {
+		return
+	}
+
+	color := busyLightFree
+	if state.Call == "active" {
+		color = busyLightCall
+		if state.Mute == "active" {
+			color = busyLightMuted
+		}
+	}
+
+	showBusyLights(topic, lights, color)
+}
+
+// Turn a topic's lights off, when its state expired
+func turnOffBusyLights(topic string) {
+	showBusyLights(topic, busyLights[topic], nil)
+}
+
+// Turn every light off, when the bridge shuts down
+func turnOffAllBusyLights() {
+	for topic, lights := range busyLights {
+		showBusyLights(topic, lights, nil)
+	}
+}
+
+// Queue a color for lights that don't show it yet
+func showBusyLights(topic string, lights []busyLight, color []byte) {
+	busyLightColorsMu.Lock()
+	defer busyLightColorsMu.Unlock()
+	for _, light := range lights {
+		light := light
+		if last, ok := busyLightColors[light]; ok && last == busyLightColorName(color) {
+			continue
+		}
+		if !busyLightQueue.enqueue(light.kind+" "+light.target, func() { setBusyLight(topic, light, color) }) {
+			logMessage(WARN, "Busy light queue is full, dropping update", "topic", topic, "light", light.target)
+			continue
+		}
+		busyLightColors[light] = busyLightColorName(color)
+	}
+}
+
+// Set a light to a color, or turn it off for a nil color
+func setBusyLight(topic string, light busyLight, color []byte) {
+	var err error
+	switch light.kind {
+	case "wled":
+		err = setWLED(light.target, color)
+	case "esphome":
+		err = setESPHomeLight(light.target, color)
+	}
+	if err != nil {
+		logMessage(ERROR, "Error setting busy light", "topic", topic, "light", light.target, "error", err)
+		recordRecentError("busy_light", topic, fmt.Sprintf("%s: %v", light.target, err))
+		// Send the color again with the next state
+		busyLightColorsMu.Lock()
+		delete(busyLightColors, light)
+		busyLightColorsMu.Unlock()
+		return
+	}
+	logMessage(DEBUG, "Set busy light", "topic", topic, "light", light.target, "color", busyLightColorName(color))
+}
+
+// Name of a color as RRGGBB, or off
+func busyLightColorName(color []byte) string {
+	if color == nil {
+		return "off"
+	}
+	return hex.EncodeToString(color)
+}
+
+// Set a WLED device's color with its JSON API
+func setWLED(target string, color []byte) error {
+	state := map[string]interface{}{"on": false}
+	if color != nil {
+		state = map[string]interface{}{
+			"on":  true,
+			"bri": busyLightBrightness,
+			"seg": []map[string]interface{}{{"col": [][]int{{int(color[0]), int(color[1]), int(color[2])}}}},
+		}
+	}
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	req, err := newOutboundRequest(http.MethodPost, strings.TrimSuffix(target, "/")+"/json/state", "application/json", body)
+	if err != nil {
+		return err
+	}
+	return sendOutbound(req, localTimeout, nil)
+}
+
+// Set an ESPHome light's color with a JSON command on its MQTT command topic
+func setESPHomeLight(commandTopic string, color []byte) error {
+	command := map[string]interface{}{"state": "OFF"}
+	if color != nil {
+		command = map[string]interface{}{
+			"state":      "ON",
+			"brightness": busyLightBrightness,
+			"color_mode": "rgb",
+			"color":      map[string]int{"r": int(color[0]), "g": int(color[1]), "b": int(color[2])},
+		}
+	}
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return publish(commandTopic, 0, false, payload)
+}
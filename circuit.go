@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned by publish while the circuit breaker is open
+var errCircuitOpen = errors.New("MQTT publishing is paused after repeated failures")
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// Stops publishing after repeated failures so requests fail right away
+// instead of each waiting out the publish timeout. Once the cooldown passed
+// a single publish is let through as a probe; it closes the circuit if it
+// succeeds and opens it again if it fails.
+type circuitBreaker struct {
+	// Consecutive failures that open the circuit, zero to never open it
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+var publishCircuit = &circuitBreaker{threshold: 5, cooldown: 30 * time.Second}
+
+// Check whether a publish may go ahead, letting through the probe once the
+// cooldown passed
+func (c *circuitBreaker) allow() bool {
+	if c.threshold <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.openedAt) < c.cooldown {
+			return false
+		}
+		c.state = circuitHalfOpen
+		c.probing = true
+		return true
+	case circuitHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	}
+	return true
+}
+
+// Check whether publishes are currently rejected, without claiming the probe
+func (c *circuitBreaker) isOpen() bool {
+	if c.threshold <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		return time.Since(c.openedAt) < c.cooldown
+	case circuitHalfOpen:
+		return c.probing
+	}
+	return false
+}
+
+// Close the circuit, when the broker connection was just established
+func (c *circuitBreaker) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = circuitClosed
+	c.failures = 0
+	c.probing = false
+}
+
+// Record the outcome of a publish the breaker let through
+func (c *circuitBreaker) record(err error) {
+	if c.threshold <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		if c.state != circuitClosed {
+			logMessage(INFO, "MQTT publishing recovered, closing the circuit breaker")
+			if offlineQueueFile != "" {
+				startOfflineReplay()
+			}
+		}
+		c.state = circuitClosed
+		c.failures = 0
+		c.probing = false
+		return
+	}
+
+	c.failures++
+	if c.state == circuitHalfOpen || (c.state == circuitClosed && c.failures >= c.threshold) {
+		c.state = circuitOpen
+		c.openedAt = time.Now()
+		c.probing = false
+		logMessage(WARN, "Consecutive publish failures, pausing publishing", "failures", c.failures, "cooldown", c.cooldown, "error", err)
+	}
+}
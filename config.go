@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read a boolean environment variable, exiting if it can't be parsed
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return b
+}
+
+// Read an integer environment variable, exiting if it can't be parsed
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return i
+}
+
+// Read a duration environment variable (e.g. "30s"), exiting if it can't be
+// parsed
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// Read a string environment variable with a default
+func envString(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// Read a string environment variable that can be overridden for a single
+// topic with a _<TOPIC> suffix, e.g. DEVICE_MODEL_LAPTOP
+func topicEnv(name string, topic string, def string) string {
+	return envString(fmt.Sprintf("%s_%s", name, strings.ToUpper(templateKey(topic))), envString(name, def))
+}
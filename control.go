@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MuteDeck API of each device that can be controlled, by topic
+var muteDeckAPIs = map[string]string{}
+
+// Path of a MuteDeck API action, {action} is replaced by the action
+var muteDeckAPIPath = "/v1/{action}"
+
+// Root of the command topics, commands for a device's entity are sent to
+// <root>/<topic>/<key>
+var commandTopicRoot = "mutedeck2mqtt/command"
+
+// MuteDeck API action for each command key
+var commandActions = map[string]string{
+	"mute":   "mute",
+	"video":  "video",
+	"share":  "share",
+	"record": "record",
+	"leave":  "leave",
+}
+
+// Last state received from each device, by topic
+var deviceStates = make(map[string]MuteDeckState)
+var deviceStatesMu sync.Mutex
+
+// Parse a comma separated list of topic=host:port entries. A value may also
+// be a full URL like https://laptop.local:3491.
+func parseMuteDeckAPIs(list string) (map[string]string, error) {
+	apis := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		topic, host, ok := strings.Cut(entry, "=")
+		topic, host = strings.TrimSpace(topic), strings.TrimSpace(host)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("expected topic=host:port, got %q", entry)
+		}
+		if err := validateTopicLevel("topic", topic); err != nil {
+			return nil, err
+		}
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		apis[topic] = strings.TrimSuffix(host, "/")
+	}
+	return apis, nil
+}
+
+// Get the command topic of a device's entity, empty if the device can't be
+// controlled
+func commandTopicFor(topic string, key string) string {
+	if key == reannounceEntity.Key && reannounceButton {
+		return fmt.Sprintf("%s/%s/%s", commandTopicRoot, topic, key)
+	}
+	if key == dndEntity.Key {
+		if !dndControllable(topic) {
+			return ""
+		}
+		return fmt.Sprintf("%s/%s/%s", commandTopicRoot, topic, key)
+	}
+	if !controllable(topic) {
+		return ""
+	}
+	if _, ok := commandActions[key]; !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%s", commandTopicRoot, topic, key)
+}
+
+// Whether commands for a device can be delivered, through its MuteDeck API,
+// its callback URL or because it's in COMMAND_POLLING
+func controllable(topic string) bool {
+	if _, ok := muteDeckAPIs[topic]; ok {
+		return true
+	}
+	return callbackFor(topic) != "" || pollingDevice(topic)
+}
+
+// Remember the last state a device sent, commands setting a field to the
+// value it already has are ignored
+func rememberDeviceState(topic string, state MuteDeckState) {
+	deviceStatesMu.Lock()
+	defer deviceStatesMu.Unlock()
+	deviceStates[topic] = state
+}
+
+// Get a status field of a device's last state, unknown if there is none
+func deviceStatus(topic string, key string) string {
+	deviceStatesMu.Lock()
+	defer deviceStatesMu.Unlock()
+	state, ok := deviceStates[topic]
+	if !ok {
+		return unknownValue
+	}
+	switch key {
+	case "mute":
+		return state.Mute
+	case "video":
+		return state.Video
+	case "share":
+		return state.Share
+	case "record":
+		return state.Record
+	}
+	return unknownValue
+}
+
+// Handle a command from Home Assistant by calling the device's MuteDeck API.
+// The API toggles, so a command naming a status (ON, OFF, active, ...) is
+// only forwarded if the field doesn't have that status yet. TOGGLE and
+// PRESS always call the API.
+func onCommand(client mqtt.Client, msg mqtt.Message) {
+	// Don't hold up the MQTT client while waiting for the API
+	go handleCommand(msg)
+}
+
+// Forward a command to the device's MuteDeck API
+func handleCommand(msg mqtt.Message) {
+	defer recoverGoroutine("command handler")
+	rest := strings.TrimPrefix(msg.Topic(), commandTopicRoot+"/")
+	topic, key, _ := strings.Cut(rest, "/")
+	payload := strings.TrimSpace(string(msg.Payload()))
+
+	if key == reannounceEntity.Key && reannounceButton {
+		if err := reannounceDevice(topic); err != nil {
+			logMessage(ERROR, "Error re-announcing device", "topic", topic, "error", err)
+			return
+		}
+		logMessage(INFO, "CMD", "topic", msg.Topic(), "payload", payload)
+		return
+	}
+
+	if key == dndEntity.Key {
+		handleDNDCommand(msg.Topic(), topic, payload)
+		return
+	}
+
+	if !controllable(topic) {
+		logMessage(WARN, "Ignoring command for unknown device", "topic", msg.Topic())
+		return
+	}
+	action, ok := commandActions[key]
+	if !ok {
+		logMessage(WARN, "Ignoring unknown command", "topic", msg.Topic())
+		return
+	}
+
+	command := strings.ToLower(payload)
+	if key != "leave" {
+		switch command {
+		case "toggle", "press":
+		default:
+			want := normalizeStatus(command)
+			if want != "active" && want != "inactive" {
+				logMessage(WARN, "Ignoring command", "topic", msg.Topic(), "payload", payload)
+				return
+			}
+			if current := deviceStatus(topic, key); current == want {
+				logMessage(DEBUG, "Field already has the commanded status", "topic", topic, "key", key, "status", want)
+				return
+			}
+			command = want
+		}
+	}
+
+	// Devices the bridge can't reach get the command through their callback
+	// or pick it up themselves
+	pending := pendingCommand{Topic: topic, Key: key, Command: command, Time: time.Now().UTC().Format(time.RFC3339)}
+	var err error
+	if base, ok := muteDeckAPIs[topic]; ok {
+		err = callMuteDeckAPI(base, action)
+	} else if callback := callbackFor(topic); callback != "" {
+		err = postCallback(callback, pending)
+	} else {
+		queueCommand(pending)
+	}
+	if err != nil {
+		logMessage(ERROR, "Error forwarding command", "topic", topic, "error", err)
+		return
+	}
+	logMessage(INFO, "CMD", "topic", msg.Topic(), "payload", payload)
+}
+
+// Set a device's DND. Unlike the MuteDeck fields the bridge knows the DND
+// status it set, so TOGGLE is sent as the status it toggles to.
+func handleDNDCommand(commandTopic string, topic string, payload string) {
+	if !dndControllable(topic) {
+		logMessage(WARN, "Ignoring command for unknown device", "topic", commandTopic)
+		return
+	}
+	current := dndStatus(topic)
+	want := normalizeStatus(strings.ToLower(payload))
+	if strings.EqualFold(payload, "toggle") {
+		want = "active"
+		if current == "active" {
+			want = "inactive"
+		}
+	}
+	if want != "active" && want != "inactive" {
+		logMessage(WARN, "Ignoring command", "topic", commandTopic, "payload", payload)
+		return
+	}
+	if current == want {
+		logMessage(DEBUG, "Field already has the commanded status", "topic", topic, "key", dndEntity.Key, "status", want)
+		return
+	}
+	if err := setDND(topic, want); err != nil {
+		logMessage(ERROR, "Error setting DND", "topic", topic, "error", err)
+		return
+	}
+	logMessage(INFO, "CMD", "topic", commandTopic, "payload", payload)
+}
+
+// Call a MuteDeck API action
+func callMuteDeckAPI(base string, action string) error {
+	req, err := newOutboundRequest(http.MethodPost, base+strings.ReplaceAll(muteDeckAPIPath, "{action}", action), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	return sendOutbound(req, localTimeout, nil)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Runs only the latest job submitted for a key once no other job arrived
+// for the length of the window
+type debouncer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingJob
+	// Jobs waiting or running
+	running sync.WaitGroup
+}
+
+type pendingJob struct {
+	timer *time.Timer
+	job   func()
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+	return &debouncer{window: window, pending: make(map[string]*pendingJob)}
+}
+
+// Submit a job for a key, replacing any job still waiting for it
+func (d *debouncer) submit(key string, job func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// A timer that already fired is about to run its job, so it's replaced
+	// with a new one instead of being reset
+	if p, ok := d.pending[key]; ok && p.timer.Stop() {
+		p.job = job
+		p.timer.Reset(d.window)
+		return
+	}
+
+	p := &pendingJob{job: job}
+	d.running.Add(1)
+	p.timer = time.AfterFunc(d.window, func() {
+		defer d.running.Done()
+		defer recoverGoroutine("debounced job")
+		d.mu.Lock()
+		// A newer job replaced this one, or flush ran it already
+		if d.pending[key] != p {
+			d.mu.Unlock()
+			return
+		}
+		job := p.job
+		delete(d.pending, key)
+		d.mu.Unlock()
+		job()
+	})
+	d.pending[key] = p
+}
+
+// Run every waiting job now instead of at the end of its window, and wait
+// for jobs already running
+func (d *debouncer) flush() {
+	d.mu.Lock()
+	var jobs []func()
+	for key, p := range d.pending {
+		// A timer that already fired runs its job itself
+		if p.timer.Stop() {
+			jobs = append(jobs, p.job)
+			delete(d.pending, key)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, job := range jobs {
+		runRecovered("debounced job", job)
+		d.running.Done()
+	}
+	d.running.Wait()
+}
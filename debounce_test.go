@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Submitting right as the window ends must neither run a job twice nor run
+// an older job after a newer one. Run with -race.
+func TestDebouncerSubmitAtEndOfWindow(t *testing.T) {
+	const window = time.Millisecond
+	d := newDebouncer(window)
+
+	var mu sync.Mutex
+	var ran []int
+	for i := 0; i < 500; i++ {
+		i := i
+		d.submit("device", func() {
+			mu.Lock()
+			ran = append(ran, i)
+			mu.Unlock()
+		})
+		// Alternate around the end of the window so some submits land
+		// while the timer is firing
+		time.Sleep(window + time.Duration(i%3-1)*window/4)
+	}
+	d.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ran) == 0 {
+		t.Fatal("no job ran")
+	}
+	for n := 1; n < len(ran); n++ {
+		if ran[n] <= ran[n-1] {
+			t.Fatalf("job %d ran after job %d", ran[n], ran[n-1])
+		}
+	}
+	if last := ran[len(ran)-1]; last != 499 {
+		t.Fatalf("last job to run was %d, want 499", last)
+	}
+}
+
+func TestDebouncerRunsLatestJobPerKey(t *testing.T) {
+	d := newDebouncer(20 * time.Millisecond)
+
+	var mu sync.Mutex
+	ran := make(map[string][]string)
+	record := func(key, value string) func() {
+		return func() {
+			mu.Lock()
+			ran[key] = append(ran[key], value)
+			mu.Unlock()
+		}
+	}
+	d.submit("laptop", record("laptop", "active"))
+	d.submit("laptop", record("laptop", "inactive"))
+	d.submit("desktop", record("desktop", "active"))
+	time.Sleep(100 * time.Millisecond)
+	d.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{"laptop", []string{"inactive"}},
+		{"desktop", []string{"active"}},
+	}
+	for _, tt := range tests {
+		if got := ran[tt.key]; len(got) != len(tt.want) || got[0] != tt.want[0] {
+			t.Errorf("%s ran %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestDebouncerFlushRunsWaitingJobs(t *testing.T) {
+	d := newDebouncer(time.Hour)
+
+	var ran int
+	d.submit("laptop", func() { ran++ })
+	d.submit("desktop", func() { ran++ })
+	d.flush()
+	if ran != 2 {
+		t.Fatalf("flush ran %d jobs, want 2", ran)
+	}
+
+	// Nothing is left to run a second time
+	d.flush()
+	if ran != 2 {
+		t.Fatalf("second flush ran %d jobs, want 2", ran)
+	}
+}
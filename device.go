@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Device metadata that can be configured, by environment variable and query
+// parameter
+var deviceFields = []struct {
+	env   string
+	query string
+	field func(*Device) *string
+}{
+	{"DEVICE_MANUFACTURER", "manufacturer", func(d *Device) *string { return &d.Manufacturer }},
+	{"DEVICE_MODEL", "model", func(d *Device) *string { return &d.Model }},
+	{"DEVICE_SW_VERSION", "sw_version", func(d *Device) *string { return &d.SoftwareVersion }},
+	{"DEVICE_HW_VERSION", "hw_version", func(d *Device) *string { return &d.HardwareVersion }},
+	{"DEVICE_SERIAL_NUMBER", "serial_number", func(d *Device) *string { return &d.SerialNumber }},
+	{"DEVICE_SUGGESTED_AREA", "suggested_area", func(d *Device) *string { return &d.SuggestedArea }},
+}
+
+// Get the metadata announced for a device. Each field is taken from the
+// request's query parameter, the topic's DEVICE_<FIELD>_<TOPIC> variable or
+// the DEVICE_<FIELD> variable, in that order.
+func deviceMetadata(r *http.Request, topic string) Device {
+	device := Device{Manufacturer: "MuteDeck"}
+	for _, f := range deviceFields {
+		value := topicEnv(f.env, topic, "")
+		if query := r.URL.Query().Get(f.query); query != "" {
+			value = query
+		}
+		if value != "" {
+			*f.field(&device) = value
+		}
+	}
+	return device
+}
+
+// Payload fields that may carry the version of MuteDeck sending it
+var versionFields = []string{"mutedeck_version", "app_version", "version"}
+
+// Get the MuteDeck version from a payload, empty if it has none
+func payloadVersion(state MuteDeckState) string {
+	for _, field := range versionFields {
+		switch value := state.Extra[field].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case float64:
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+	return ""
+}
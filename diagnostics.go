@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Counters describing how the bridge is doing
+type bridgeStats struct {
+	mu                sync.Mutex
+	messagesPublished int64
+	publishErrors     int64
+	lastError         string
+	lastErrorTime     time.Time
+}
+
+var stats bridgeStats
+
+// When the bridge started
+var startTime = time.Now()
+
+// Record the outcome of a publish
+func (s *bridgeStats) recordPublish(err error) {
+	if err != nil {
+		s.recordError(err)
+		s.mu.Lock()
+		s.publishErrors++
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Lock()
+	s.messagesPublished++
+	s.mu.Unlock()
+}
+
+// Remember the most recent error
+func (s *bridgeStats) recordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+}
+
+// Bridge diagnostics payload
+type DiagnosticsPayload struct {
+	Connected         bool            `json:"connected"`
+	Brokers           map[string]bool `json:"brokers"`
+	MessagesPublished int64           `json:"messages_published"`
+	PublishErrors     int64           `json:"publish_errors"`
+	LastError         string          `json:"last_error"`
+	LastErrorTime     string          `json:"last_error_time,omitempty"`
+	Version           string          `json:"version"`
+	Uptime            int64           `json:"uptime"`
+	Devices           int             `json:"devices"`
+	RecentErrors      []RecentError   `json:"recent_errors"`
+}
+
+func (s *bridgeStats) diagnostics() DiagnosticsPayload {
+	mu.Lock()
+	devices := len(discoveryMessages)
+	mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payload := DiagnosticsPayload{
+		Brokers:           make(map[string]bool),
+		MessagesPublished: s.messagesPublished,
+		PublishErrors:     s.publishErrors,
+		LastError:         s.lastError,
+		Version:           version,
+		Uptime:            int64(time.Since(startTime).Seconds()),
+		Devices:           devices,
+		RecentErrors:      recentErrorList(),
+	}
+	if !s.lastErrorTime.IsZero() {
+		payload.LastErrorTime = s.lastErrorTime.Format(time.RFC3339)
+	}
+	for i, b := range brokers {
+		connected := b.isConnected()
+		payload.Brokers[b.name] = connected
+		if i == 0 {
+			payload.Connected = connected
+		}
+	}
+	return payload
+}
+
+// Publish the bridge diagnostics to every connected broker
+func publishDiagnostics(topic string) {
+	jsonData, err := json.Marshal(stats.diagnostics())
+	if err != nil {
+		logMessage(ERROR, "Error marshaling diagnostics JSON data", "error", err)
+		return
+	}
+
+	for _, b := range brokers {
+		if !b.isConnected() {
+			continue
+		}
+		if err := b.publish(topic, 0, true, jsonData); err != nil {
+			logMessage(WARN, "Error publishing diagnostics to MQTT broker", "broker", b.name, "error", err)
+			continue
+		}
+		logMessage(DEBUG, "Diagnostics sent to MQTT broker", "broker", b.name, "payload", string(jsonData))
+	}
+}
+
+// Topic the bridge diagnostics are published to
+var bridgeStateTopic = "mutedeck2mqtt/bridge/state"
+
+// Publish the bridge diagnostics on a fixed interval
+func runDiagnostics(topic string, interval time.Duration) {
+	if bridgeDiscovery {
+		if err := announceBridge(topic, interval); err != nil {
+			logMessage(ERROR, "Error publishing discovery message to MQTT topic", "error", err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		publishDiagnostics(topic)
+		<-ticker.C
+	}
+}
+
+// Liveness check, the bridge is alive as long as it can answer
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// Readiness check, the bridge is only ready while connected to the primary
+// broker, or while Home Assistant is reachable without one
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if homeAssistantURL != "" {
+		if !homeAssistantReachable.Load() {
+			http.Error(w, "not connected to Home Assistant", http.StatusServiceUnavailable)
+			return
+		}
+	} else if len(brokers) == 0 || !brokers[0].isConnected() {
+		http.Error(w, "not connected to MQTT broker", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// A Home Assistant entity generated from a payload field
+type entity struct {
+	Key      string
+	Name     string
+	Icon     string
+	Platform string
+	Options  []string
+	// Device class of sensors and binary sensors, and the unit of sensors
+	DeviceClass string
+	Unit        string
+	// Event types of event entities
+	EventTypes []string
+	// Entity category, empty for entities shown on the main dashboards
+	Category string
+	// Subtopic of the state topic the entity reads instead of the state
+	Topic string
+	// ON while the field is not active, like the microphone being on while
+	// mute isn't active
+	Inverted bool
+}
+
+// Template extracting the entity's value from the state. With perField set
+// the state is the field's own ON/OFF payload instead of the JSON state.
+func (e entity) valueTemplate(perField bool) string {
+	value := fmt.Sprintf("value_json.%s", e.Key)
+	if perField {
+		value = "value"
+	}
+	switch {
+	case e.Platform == "event" || e.Platform == "button":
+		// Events are read from their JSON payload, buttons have no state
+		return ""
+	case e.DeviceClass == "timestamp":
+		return fmt.Sprintf("{{ %s or 'None' }}", value)
+	case e.Platform != "binary_sensor" && e.Platform != "switch":
+		return fmt.Sprintf("{{ %s }}", value)
+	}
+
+	if perField {
+		if e.Inverted {
+			return "{{ value == 'unknown' and 'None' or value == 'ON' and 'OFF' or 'ON' }}"
+		}
+		return "{{ value == 'unknown' and 'None' or value }}"
+	}
+	if e.Inverted {
+		return fmt.Sprintf("{{ %[1]s == 'unknown' and 'None' or %[1]s == 'active' and 'OFF' or 'ON' }}", value)
+	}
+	return fmt.Sprintf("{{ %[1]s == 'unknown' and 'None' or %[1]s != 'active' and 'OFF' or 'ON' }}", value)
+}
+
+// Entities for the fields MuteDeck always sends
+var entities = []entity{
+	{Key: "call", Name: "Call", Icon: "mdi:phone", Platform: "binary_sensor", Options: []string{}, DeviceClass: "occupancy"},
+	// The options come from controlOptions
+	{Key: "control", Name: "Control", Icon: "mdi:application-cog", Platform: "select", Category: "diagnostic"},
+	{Key: "mute", Name: "Microphone", Icon: "mdi:microphone", Platform: "binary_sensor", Options: []string{}, DeviceClass: "sound", Inverted: true},
+	{Key: "record", Name: "Recording", Icon: "mdi:record-rec", Platform: "binary_sensor", Options: []string{}, DeviceClass: "running"},
+	{Key: "share", Name: "Screen sharing", Icon: "mdi:monitor-share", Platform: "binary_sensor", Options: []string{}, DeviceClass: "running"},
+	{Key: "video", Name: "Video", Icon: "mdi:video", Platform: "binary_sensor", Options: []string{}, DeviceClass: "running"},
+	{Key: "in_meeting", Name: "In meeting", Icon: "mdi:account-group", Platform: "binary_sensor", Options: []string{}, DeviceClass: "occupancy"},
+}
+
+// Platforms offered by the control select, extended with the platforms seen
+// in payloads unless autoControlOptions is off
+var controlOptions = []string{"Zoom", "Teams", "Google Meet", "StreamYard", "Webex", "System"}
+var autoControlOptions = true
+var controlOptionsMu sync.Mutex
+
+// Limits on the platforms learned from payloads, so a client can't grow the
+// select's options, and every device's discovery config, without bound
+const maxControlOptions = 32
+const maxControlOptionLength = 64
+
+// Add a platform to the control options if it's new
+func learnControlOption(platform string) {
+	if !autoControlOptions || platform == "" || platform == unknownValue {
+		return
+	}
+	if len(platform) > maxControlOptionLength || strings.IndexFunc(platform, unicode.IsControl) >= 0 {
+		logMessage(WARN, "Ignoring an invalid control option", "option", platform)
+		return
+	}
+
+	controlOptionsMu.Lock()
+	defer controlOptionsMu.Unlock()
+	for _, option := range controlOptions {
+		if option == platform {
+			return
+		}
+	}
+	if len(controlOptions) >= maxControlOptions {
+		logMessage(WARN, "Too many control options, not adding another", "option", platform, "limit", maxControlOptions)
+		return
+	}
+	controlOptions = append(controlOptions, platform)
+	logMessage(INFO, "Added a control option", "option", platform)
+}
+
+// Learn the control options of the cached discovery messages
+func learnCachedControlOptions() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, payload := range discoveryMessages {
+		for _, component := range payload.Components {
+			if strings.HasSuffix(component.UniqueID, "_control_mutedeck2mqtt") {
+				for _, option := range component.Options {
+					learnControlOption(option)
+				}
+			}
+		}
+	}
+}
+
+// Parse a comma separated list of control options
+func parseControlOptions(list string) []string {
+	var options []string
+	for _, option := range strings.Split(list, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// Entities for fields newer MuteDeck versions may send, only announced once
+// a payload contains them
+var extraEntities = []entity{
+	{Key: "hand", Name: "Raised hand", Icon: "mdi:hand-back-right", Platform: "binary_sensor", Options: []string{}},
+	{Key: "speaker", Name: "Speaker", Icon: "mdi:volume-high", Platform: "binary_sensor", Options: []string{}, DeviceClass: "sound", Inverted: true},
+}
+
+// Entities tracking meetings, announced with MEETING_TRACKING
+var meetingEntities = []entity{
+	{Key: "meeting_started_at", Name: "Meeting started", Icon: "mdi:clock-start", Platform: "sensor", DeviceClass: "timestamp"},
+	{Key: "meeting_duration", Name: "Meeting duration", Icon: "mdi:timer-outline", Platform: "sensor", DeviceClass: "duration", Unit: "s"},
+	{Key: "meeting", Name: "Meeting", Icon: "mdi:calendar-clock", Platform: "event", EventTypes: []string{"meeting_started", "meeting_ended"}, Topic: "event"},
+}
+
+// Entity for when a device last posted, announced with LAST_SEEN
+var lastSeenEntity = entity{Key: "last_seen", Name: "Last seen", Icon: "mdi:clock-check-outline", Platform: "sensor", DeviceClass: "timestamp", Category: "diagnostic", Topic: "last_seen"}
+
+// Category of every entity without an ENTITY_<KEY>_CATEGORY override, empty
+// to use each entity's own category
+var entityCategory = ""
+
+// Announce the entities of devices that can be controlled as switches
+var controlSwitches = true
+var switchEntities = map[string]bool{"mute": true, "video": true}
+
+// Button leaving the meeting, announced for devices with a MuteDeck API
+var leaveEntity = entity{Key: "leave", Name: "Leave meeting", Icon: "mdi:phone-hangup", Platform: "button"}
+
+// Button resending the device's discovery message, for when Home Assistant
+// lost its entities
+var reannounceButton = true
+var reannounceEntity = entity{Key: "reannounce", Name: "Re-announce", Icon: "mdi:refresh", Platform: "button", Category: "config"}
+
+// Announce entities for recognized extra fields
+var discoverExtraFields = false
+
+// Check the ENTITY_<KEY>_<FIELD> and ENTITY_<KEY>_<FIELD>_<TOPIC> variables
+// overriding how entities are announced
+func checkEntityOverrides() error {
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, "ENTITY_") || name == "ENTITY_EXPIRE_AFTER" || name == "ENTITY_LANGUAGE" || name == "ENTITY_CATEGORY" || value == "" {
+			continue
+		}
+		// Keys may contain underscores themselves, like IN_MEETING, so the
+		// longest matching key wins
+		var key, field string
+		for _, list := range [][]entity{entities, extraEntities, meetingEntities, {lastSeenEntity, leaveEntity, reannounceEntity, dndEntity}} {
+			for _, e := range list {
+				if rest := strings.TrimPrefix(name, fmt.Sprintf("ENTITY_%s_", strings.ToUpper(e.Key))); rest != name && len(e.Key) > len(key) {
+					key = e.Key
+					field, _, _ = strings.Cut(rest, "_")
+					if strings.HasPrefix(rest, "DEVICE_CLASS") {
+						field = "DEVICE_CLASS"
+					}
+				}
+			}
+		}
+		if field == "" {
+			return fmt.Errorf("%s: unknown entity", name)
+		}
+		switch field {
+		case "NAME", "ICON", "DEVICE_CLASS":
+		case "ENABLED":
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		case "CATEGORY":
+			if !validEntityCategory(value) {
+				return fmt.Errorf("%s: expected diagnostic, config or none, got %q", name, value)
+			}
+		default:
+			return fmt.Errorf("%s: unknown field %s, expected NAME, ICON, ENABLED, CATEGORY or DEVICE_CLASS", name, field)
+		}
+	}
+	return nil
+}
+
+func validEntityCategory(category string) bool {
+	return category == "diagnostic" || category == "config" || category == "none"
+}
+
+// Get the entities left out for a topic from DISABLED_ENTITIES or
+// DISABLED_ENTITIES_<TOPIC>
+func disabledEntities(topic string) map[string]bool {
+	disabled := make(map[string]bool)
+	for _, key := range strings.Split(topicEnv("DISABLED_ENTITIES", topic, ""), ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			disabled[key] = true
+		}
+	}
+	return disabled
+}
+
+// Check that DISABLED_ENTITIES and DISABLED_ENTITIES_<TOPIC> only name known
+// entities
+func checkDisabledEntities() error {
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if name != "DISABLED_ENTITIES" && !strings.HasPrefix(name, "DISABLED_ENTITIES_") {
+			continue
+		}
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.ToLower(strings.TrimSpace(key)); key != "" && findEntity(key) == nil {
+				return fmt.Errorf("%s: unknown entity %q", name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Entities showing the payload as received as their attributes, and the
+// template applied to it
+var attributesEntities = map[string]bool{}
+var attributesTemplate = ""
+
+// Topic a device's payload is published to as attributes
+func attributesTopic(fullTopic string) string {
+	return fmt.Sprintf("%s/attributes", fullTopic)
+}
+
+// Parse a comma separated list of entity keys
+func parseEntityKeys(list string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); key == "" {
+			continue
+		}
+		if findEntity(key) == nil {
+			return nil, fmt.Errorf("unknown entity %q", key)
+		}
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// Find the entity for a payload field, nil if there is none
+func findEntity(key string) *entity {
+	for _, list := range [][]entity{entities, extraEntities, meetingEntities, {lastSeenEntity, leaveEntity, reannounceEntity, dndEntity}} {
+		for i := range list {
+			if list[i].Key == key {
+				return &list[i]
+			}
+		}
+	}
+	return nil
+}
+
+// How long Home Assistant keeps a sensor's state without an update before
+// marking it unavailable, zero to keep it forever
+var entityExpireAfter time.Duration
+
+// Build the discovery component for an entity of a device. Its IDs are built
+// from the device's ID, not its topic.
+func newComponent(topic string, stateTopic string, e entity) Component {
+	id := deviceIDOf(topic)
+	fullTopic := stateTopic
+	// Without the JSON state, entities read their field's own topic
+	perField := stateFormat == "fields"
+	switch {
+	case e.Topic != "":
+		stateTopic = fmt.Sprintf("%s/%s", stateTopic, e.Topic)
+		perField = true
+	case perField:
+		stateTopic = fmt.Sprintf("%s/%s", stateTopic, e.Key)
+	}
+
+	// Apply the entity's overrides for this topic
+	override := fmt.Sprintf("ENTITY_%s_", strings.ToUpper(e.Key))
+	enabled, _ := strconv.ParseBool(topicEnv(override+"ENABLED", topic, "true"))
+	category := e.Category
+	if entityCategory != "" {
+		category = entityCategory
+	}
+	if category = topicEnv(override+"CATEGORY", topic, category); category == "none" {
+		category = ""
+	}
+
+	// Devices that can be controlled get switches instead of binary sensors
+	controlled := commandTopicFor(topic, e.Key)
+	if controlled != "" && controlSwitches && switchEntities[e.Key] {
+		e.Platform = "switch"
+		e.DeviceClass = "switch"
+	}
+
+	deviceClass := topicEnv(override+"DEVICE_CLASS", topic, e.DeviceClass)
+	if deviceClass == "none" {
+		deviceClass = ""
+	}
+	// A binary sensor's class set for the entity isn't valid for a switch
+	if e.Platform == "switch" && deviceClass != "" && deviceClass != "switch" && deviceClass != "outlet" {
+		deviceClass = "switch"
+	}
+
+	// Only sensors support expire_after
+	expireAfter := 0
+	if e.Platform == "binary_sensor" || e.Platform == "sensor" {
+		expireAfter = int(entityExpireAfter.Seconds())
+	}
+
+	// Only entities with a state accept a command topic, devices with a
+	// MuteDeck API get a real one
+	commandTopic := "mutedeck2mqtt/no-reply"
+	if e.Platform == "event" || e.Platform == "sensor" {
+		commandTopic = ""
+	}
+	if controlled != "" {
+		commandTopic = controlled
+	}
+
+	options := e.Options
+	if e.Key == "control" {
+		controlOptionsMu.Lock()
+		options = append([]string(nil), controlOptions...)
+		controlOptionsMu.Unlock()
+	}
+
+	component := Component{
+		CommandTopic:     commandTopic,
+		EnabledByDefault: enabled,
+		EntityCategory:   category,
+		Icon:             topicEnv(override+"ICON", topic, e.Icon),
+		Name:             topicEnv(override+"NAME", topic, localizedName(e.Key, e.Name)),
+		ObjectID:         fmt.Sprintf("%s_%s", id, e.Key),
+		Optimistic:       false,
+		Options:          options,
+		Platform:         e.Platform,
+		StateTopic:       stateTopic,
+		UniqueID:         fmt.Sprintf("%s_%s_mutedeck2mqtt", id, e.Key),
+		ValueTemplate:    e.valueTemplate(perField),
+		ExpireAfter:      expireAfter,
+		DeviceClass:      deviceClass,
+		Unit:             e.Unit,
+		EventTypes:       e.EventTypes,
+	}
+	if e.Platform == "button" {
+		component.StateTopic = ""
+	}
+	if e.Platform == "switch" {
+		// The state reads ON while the switch is on, commands name the
+		// status the field should get
+		component.PayloadOn, component.PayloadOff = "active", "inactive"
+		if e.Inverted {
+			component.PayloadOn, component.PayloadOff = "inactive", "active"
+		}
+		component.StateOn, component.StateOff = "ON", "OFF"
+	}
+	if attributesEntities[e.Key] {
+		component.JSONAttributesTopic = attributesTopic(fullTopic)
+		component.JSONAttributesTemplate = attributesTemplate
+	}
+	return component
+}
+
+// The bridge as the origin of discovery messages
+var origin = Origin{
+	Name:            "MuteDeck2MQTT",
+	SoftwareVersion: version,
+	URL:             "https://github.com/chelming/mutedeck2mqtt/",
+}
+
+// Build the discovery message for a device
+func buildDiscoveryPayload(u stateUpdate) DiscoveryPayloadStruct {
+	id := deviceIDOf(u.topic)
+	components := make(map[string]Component)
+	for _, e := range entities {
+		if u.state.Omit[e.Key] {
+			continue
+		}
+		components[fmt.Sprintf("%s_%s", id, e.Key)] = newComponent(u.topic, u.fullTopic, e)
+	}
+	if meetingTracking {
+		for _, e := range meetingEntities {
+			if !u.state.Omit[e.Key] {
+				components[fmt.Sprintf("%s_%s", id, e.Key)] = newComponent(u.topic, u.fullTopic, e)
+			}
+		}
+	}
+	if lastSeen && !u.state.Omit[lastSeenEntity.Key] {
+		components[fmt.Sprintf("%s_%s", id, lastSeenEntity.Key)] = newComponent(u.topic, u.fullTopic, lastSeenEntity)
+	}
+	if commandTopicFor(u.topic, leaveEntity.Key) != "" && !u.state.Omit[leaveEntity.Key] {
+		components[fmt.Sprintf("%s_%s", id, leaveEntity.Key)] = newComponent(u.topic, u.fullTopic, leaveEntity)
+	}
+	if dndControllable(u.topic) && !u.state.Omit[dndEntity.Key] {
+		components[fmt.Sprintf("%s_%s", id, dndEntity.Key)] = newComponent(u.topic, u.fullTopic, dndEntity)
+	}
+	if reannounceButton && !u.state.Omit[reannounceEntity.Key] {
+		components[fmt.Sprintf("%s_%s", id, reannounceEntity.Key)] = newComponent(u.topic, u.fullTopic, reannounceEntity)
+	}
+	if discoverExtraFields {
+		for _, e := range extraEntities {
+			if _, ok := u.state.Extra[e.Key]; ok && !u.state.Omit[e.Key] {
+				components[fmt.Sprintf("%s_%s", id, e.Key)] = newComponent(u.topic, u.fullTopic, e)
+			}
+		}
+	}
+
+	// Entities are available while both the bridge and the device are online
+	availability := []Availability{{Topic: availabilityTopic}}
+	availabilityMode := ""
+	if deviceAvailability {
+		availability = append(availability, Availability{Topic: deviceAvailabilityTopic(u.fullTopic)})
+		availabilityMode = "all"
+	}
+
+	return DiscoveryPayloadStruct{
+		Device: Device{
+			IDs:             []string{fmt.Sprintf("%s_%s", object_id, id)},
+			Name:            toTitleCase(u.topic),
+			Manufacturer:    u.device.Manufacturer,
+			Model:           u.device.Model,
+			SoftwareVersion: u.device.SoftwareVersion,
+			SerialNumber:    u.device.SerialNumber,
+			HardwareVersion: u.device.HardwareVersion,
+			SuggestedArea:   u.device.SuggestedArea,
+		},
+		Origin:           origin,
+		Components:       components,
+		StateTopic:       u.fullTopic,
+		QualityOfService: 0,
+		Availability:     availability,
+		AvailabilityMode: availabilityMode,
+	}
+}
+
+// Publish a discovery message, retrying it in the background with a growing
+// delay if the broker doesn't acknowledge it, or with an offline queue
+// queueing it like a state. An empty payload removes the discovery config.
+func publishDiscovery(ctx context.Context, topic string, payload []byte) error {
+	retained := discoveryRetain || len(payload) == 0
+	if offlineQueueFile != "" {
+		return publishOrQueue(ctx, topic, discoveryQoS, retained, payload)
+	}
+	return publishRetried(ctx, backoff{initial: time.Second, retries: discoveryRetries}, topic, discoveryQoS, retained, payload)
+}
+
+// Publish discovery as one message per device or, in the legacy "entity"
+// format, one message per entity
+var discoveryFormat = "device"
+
+// Discovery message for a single entity in the legacy format
+type EntityDiscoveryPayload struct {
+	Component
+	Device           Device         `json:"dev"`
+	Origin           Origin         `json:"o"`
+	QualityOfService int            `json:"qos"`
+	Availability     []Availability `json:"avty,omitempty"`
+	AvailabilityMode string         `json:"avty_mode,omitempty"`
+}
+
+// Get the discovery messages announcing a device, by topic. In the device
+// format that's the payload itself on the device's discovery topic, in the
+// entity format every component is sent to its own
+// <prefix>/<platform>/mutedeck2mqtt_device/<object id>/config topic.
+func discoveryMessagesFor(discoveryTopic string, payload DiscoveryPayloadStruct) (map[string][]byte, error) {
+	if discoveryFormat != "entity" {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{discoveryTopic: data}, nil
+	}
+
+	messages := make(map[string][]byte, len(payload.Components))
+	for _, component := range payload.Components {
+		topic := entityConfigTopic(discoveryTopic, component)
+		component.Platform = ""
+		data, err := json.Marshal(EntityDiscoveryPayload{
+			Component:        component,
+			Device:           payload.Device,
+			Origin:           payload.Origin,
+			QualityOfService: payload.QualityOfService,
+			Availability:     payload.Availability,
+			AvailabilityMode: payload.AvailabilityMode,
+		})
+		if err != nil {
+			return nil, err
+		}
+		messages[topic] = data
+	}
+	return messages, nil
+}
+
+// Config topic of a component in the entity format
+func entityConfigTopic(discoveryTopic string, component Component) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", discoveryPrefixOf(discoveryTopic), component.Platform, object_id, component.ObjectID)
+}
+
+// Devices whose config topics of the other format were cleared since the
+// bridge started, by discovery topic. Guarded by mu.
+var otherFormatCleared = make(map[string]bool)
+
+// Clear the config topics a device would have in the other discovery format,
+// once per device after the bridge starts, so switching DISCOVERY_FORMAT
+// doesn't leave its entities announced twice. The entity format's topics are
+// those of the payload's components.
+func clearOtherDiscoveryFormat(ctx context.Context, discoveryTopic string, payload DiscoveryPayloadStruct) error {
+	mu.Lock()
+	cleared := otherFormatCleared[discoveryTopic]
+	otherFormatCleared[discoveryTopic] = true
+	mu.Unlock()
+	if cleared {
+		return nil
+	}
+
+	topics := []string{discoveryTopic}
+	if discoveryFormat != "entity" {
+		topics = topics[:0]
+		for _, component := range payload.Components {
+			topics = append(topics, entityConfigTopic(discoveryTopic, component))
+		}
+	}
+	for _, topic := range topics {
+		if err := publishDiscovery(ctx, topic, []byte{}); err != nil {
+			mu.Lock()
+			delete(otherFormatCleared, discoveryTopic)
+			mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewComponentDeviceClass(t *testing.T) {
+	saved := muteDeckAPIs
+	defer func() { muteDeckAPIs = saved }()
+	muteDeckAPIs = map[string]string{"controlled": "http://192.168.1.20:3492"}
+
+	tests := []struct {
+		name     string
+		topic    string
+		key      string
+		env      map[string]string
+		platform string
+		class    string
+	}{
+		{name: "binary sensor keeps its class", topic: "laptop", key: "call", platform: "binary_sensor", class: "occupancy"},
+		{name: "inverted binary sensor", topic: "laptop", key: "mute", platform: "binary_sensor", class: "sound"},
+		{name: "select has no class", topic: "laptop", key: "control", platform: "select"},
+		{name: "controlled field becomes a switch", topic: "controlled", key: "mute", platform: "switch", class: "switch"},
+		{name: "controlled field without a switch", topic: "controlled", key: "call", platform: "binary_sensor", class: "occupancy"},
+		{name: "override for a sensor", topic: "laptop", key: "video", env: map[string]string{"ENTITY_VIDEO_DEVICE_CLASS": "power"}, platform: "binary_sensor", class: "power"},
+		{name: "override removed", topic: "laptop", key: "call", env: map[string]string{"ENTITY_CALL_DEVICE_CLASS": "none"}, platform: "binary_sensor"},
+		{name: "sensor override isn't valid for a switch", topic: "controlled", key: "video", env: map[string]string{"ENTITY_VIDEO_DEVICE_CLASS": "running"}, platform: "switch", class: "switch"},
+		{name: "switch override", topic: "controlled", key: "video", env: map[string]string{"ENTITY_VIDEO_DEVICE_CLASS": "outlet"}, platform: "switch", class: "outlet"},
+		{name: "override for one topic", topic: "laptop", key: "call", env: map[string]string{"ENTITY_CALL_DEVICE_CLASS_LAPTOP": "presence"}, platform: "binary_sensor", class: "presence"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			component := newComponent(tt.topic, "mutedeck2mqtt/"+tt.topic, *findEntity(tt.key))
+			if component.Platform != tt.platform || component.DeviceClass != tt.class {
+				t.Errorf("got platform %q with class %q, want %q with %q", component.Platform, component.DeviceClass, tt.platform, tt.class)
+			}
+		})
+	}
+}
+
+func TestDiscoveryMessagesFor(t *testing.T) {
+	saved := discoveryFormat
+	defer func() { discoveryFormat = saved }()
+
+	payload := DiscoveryPayloadStruct{
+		Device: Device{IDs: []string{"laptop"}, Name: "Laptop"},
+		Components: map[string]Component{
+			"laptop_call":    newComponent("laptop", "mutedeck2mqtt/laptop", *findEntity("call")),
+			"laptop_control": newComponent("laptop", "mutedeck2mqtt/laptop", *findEntity("control")),
+		},
+	}
+	discoveryTopic := "homeassistant/device/mutedeck2mqtt_device_laptop/config"
+
+	tests := []struct {
+		format string
+		topics []string
+	}{
+		{"device", []string{discoveryTopic}},
+		{"entity", []string{
+			"homeassistant/binary_sensor/mutedeck2mqtt_device/laptop_call/config",
+			"homeassistant/select/mutedeck2mqtt_device/laptop_control/config",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			discoveryFormat = tt.format
+			messages, err := discoveryMessagesFor(discoveryTopic, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != len(tt.topics) {
+				t.Fatalf("got %d messages, want %d", len(messages), len(tt.topics))
+			}
+			for _, topic := range tt.topics {
+				data, ok := messages[topic]
+				if !ok {
+					t.Fatalf("no message on %s", topic)
+				}
+				var decoded map[string]interface{}
+				if err := json.Unmarshal(data, &decoded); err != nil {
+					t.Fatalf("message on %s isn't JSON: %v", topic, err)
+				}
+				if _, ok := decoded["dev"]; !ok {
+					t.Errorf("message on %s has no device", topic)
+				}
+			}
+		})
+	}
+}
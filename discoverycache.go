@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File the discovery messages are saved to, empty to keep them in memory only
+var discoveryCacheFile string
+var discoveryCacheMu sync.Mutex
+
+// When each cached device last posted, by discovery topic. Devices silent
+// for discoveryCacheTTL are forgotten, and the least recently seen ones once
+// more than discoveryCacheMaxEntries are cached. Zero means no limit.
+var discoveryLastSeen = make(map[string]time.Time)
+var discoveryCacheTTL time.Duration
+var discoveryCacheMaxEntries int
+
+// Cache a device's discovery message once it was sent, evicting the least
+// recently seen devices over the limit. Must be called with mu held.
+func cacheDiscovery(discoveryTopic string, payload DiscoveryPayloadStruct) {
+	discoveryTopics[discoveryTopic] = true
+	discoveryMessages[discoveryTopic] = payload
+	discoveryLastSeen[discoveryTopic] = time.Now()
+
+	for discoveryCacheMaxEntries > 0 && len(discoveryMessages) > discoveryCacheMaxEntries {
+		oldest := ""
+		for topic := range discoveryMessages {
+			if topic != discoveryTopic && (oldest == "" || discoveryLastSeen[topic].Before(discoveryLastSeen[oldest])) {
+				oldest = topic
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		logMessage(INFO, "Discovery cache is full, forgetting the oldest entry", "topic", oldest)
+		uncacheDiscovery(oldest)
+	}
+}
+
+// Drop a device from the discovery cache. Must be called with mu held.
+func uncacheDiscovery(discoveryTopic string) {
+	delete(discoveryTopics, discoveryTopic)
+	delete(discoveryMessages, discoveryTopic)
+	delete(discoveryLastSeen, discoveryTopic)
+}
+
+// Forget the cached devices that didn't post since before, or all of them if
+// before is zero, and only the one with a discovery topic if it's not empty.
+// The devices stay in Home Assistant and are announced again with their next
+// webhook. Returns the forgotten discovery topics.
+func purgeDiscoveryCache(before time.Time, discoveryTopic string) []string {
+	mu.Lock()
+	var purged []string
+	for topic := range discoveryMessages {
+		if discoveryTopic != "" && topic != discoveryTopic {
+			continue
+		}
+		if !before.IsZero() && !discoveryLastSeen[topic].Before(before) {
+			continue
+		}
+		uncacheDiscovery(topic)
+		purged = append(purged, topic)
+	}
+	mu.Unlock()
+
+	if len(purged) > 0 {
+		saveDiscoveryCache()
+	}
+	sort.Strings(purged)
+	return purged
+}
+
+// Forget devices that didn't post for discoveryCacheTTL, checking every
+// minute
+func runDiscoveryCacheExpiry() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, topic := range purgeDiscoveryCache(time.Now().Add(-discoveryCacheTTL), "") {
+			logMessage(INFO, "No update within DISCOVERY_CACHE_TTL, forgot discovery cache entry", "topic", topic, "ttl", discoveryCacheTTL)
+		}
+	}
+}
+
+// Purge the discovery cache with DELETE /admin/discovery-cache. ?older_than=
+// only forgets devices silent for that long, ?topic= and ?discovery_prefix=
+// only a single device.
+func handleDiscoveryCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var before time.Time
+	if value := r.URL.Query().Get("older_than"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil || age <= 0 {
+			http.Error(w, fmt.Sprintf("invalid older_than: %q", value), http.StatusBadRequest)
+			return
+		}
+		before = time.Now().Add(-age)
+	}
+	discoveryTopic := ""
+	if topic := r.URL.Query().Get("topic"); topic != "" {
+		if err := validateTopicLevel("topic", topic); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		discoveryPrefix := discovery_prefix
+		if value := r.URL.Query().Get("discovery_prefix"); value != "" {
+			discoveryPrefix = value
+		}
+		discoveryTopic = deviceDiscoveryTopic(discoveryPrefix, topic)
+	}
+
+	purged := purgeDiscoveryCache(before, discoveryTopic)
+	logRequest(r, INFO, "Purged discovery cache entries", "count", len(purged))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"purged": append([]string{}, purged...)})
+}
+
+// Load the discovery messages saved by an earlier run. A missing file is not
+// an error.
+func loadDiscoveryCache(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var messages map[string]DiscoveryPayloadStruct
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for topic, payload := range messages {
+		cacheDiscovery(topic, payload)
+	}
+	logMessage(INFO, "Loaded discovery messages", "count", len(messages), "path", path)
+	return nil
+}
+
+// Save the discovery messages so they survive a restart. The file is replaced
+// atomically so a crash can't leave it half written.
+func saveDiscoveryCache() {
+	if discoveryCacheFile == "" {
+		return
+	}
+
+	discoveryCacheMu.Lock()
+	defer discoveryCacheMu.Unlock()
+
+	mu.Lock()
+	data, err := json.Marshal(discoveryMessages)
+	mu.Unlock()
+	if err != nil {
+		logMessage(ERROR, "Error marshaling discovery cache", "error", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(discoveryCacheFile), ".discovery-*.tmp")
+	if err != nil {
+		logMessage(ERROR, "Error saving discovery cache", "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		logMessage(ERROR, "Error saving discovery cache", "error", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		logMessage(ERROR, "Error saving discovery cache", "error", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), discoveryCacheFile); err != nil {
+		logMessage(ERROR, "Error saving discovery cache", "error", err)
+		return
+	}
+	logMessage(DEBUG, "Saved discovery cache", "path", discoveryCacheFile)
+}
+
+// A cached device as served by /devices
+type DevicePayload struct {
+	Topic          string   `json:"topic"`
+	StateTopic     string   `json:"state_topic"`
+	DiscoveryTopic string   `json:"discovery_topic"`
+	Announced      bool     `json:"announced"`
+	LastSeen       string   `json:"last_seen"`
+	Components     []string `json:"components"`
+	// Discovery messages generated for the device, by topic
+	Messages map[string]json.RawMessage `json:"messages"`
+}
+
+// Serve every device in the discovery cache with GET /devices, along with
+// the discovery messages generated for it, to debug discovery without
+// subscribing to the broker
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mu.Lock()
+	cached := make(map[string]DiscoveryPayloadStruct, len(discoveryMessages))
+	for topic, payload := range discoveryMessages {
+		cached[topic] = payload
+	}
+	announced := make(map[string]bool, len(discoveryTopics))
+	for topic, sent := range discoveryTopics {
+		announced[topic] = sent
+	}
+	lastSeen := make(map[string]time.Time, len(discoveryLastSeen))
+	for topic, seen := range discoveryLastSeen {
+		lastSeen[topic] = seen
+	}
+	mu.Unlock()
+
+	devices := make([]DevicePayload, 0, len(cached))
+	for discoveryTopic, payload := range cached {
+		messages, err := discoveryMessagesFor(discoveryTopic, payload)
+		if err != nil {
+			logRequest(r, ERROR, "Error generating discovery messages", "topic", discoveryTopic, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		device := DevicePayload{
+			Topic:          deviceTopicOf(discoveryTopic),
+			StateTopic:     payload.StateTopic,
+			DiscoveryTopic: discoveryTopic,
+			Announced:      announced[discoveryTopic],
+			LastSeen:       lastSeen[discoveryTopic].UTC().Format(time.RFC3339),
+			Components:     make([]string, 0, len(payload.Components)),
+			Messages:       make(map[string]json.RawMessage, len(messages)),
+		}
+		for key := range payload.Components {
+			device.Components = append(device.Components, key)
+		}
+		sort.Strings(device.Components)
+		for topic, data := range messages {
+			device.Messages[topic] = json.RawMessage(data)
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DiscoveryTopic < devices[j].DiscoveryTopic
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// Get the topic of a device from its discovery topic
+func deviceTopicOf(discoveryTopic string) string {
+	id := strings.TrimPrefix(discoveryTopic, discoveryPrefixOf(discoveryTopic)+"/device/"+object_id+"_")
+	return topicOfDevice(strings.TrimSuffix(id, "/config"))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Announce a do-not-disturb switch for devices whose DND can be set
+var dndSwitch = false
+
+// URL DND commands are posted to, or script run with the topic and on or
+// off. Empty to send them to the device like its other commands.
+var dndCommand = ""
+
+// Longest a DND script may run
+const dndCommandTimeout = 10 * time.Second
+
+// Switch turning on the OS's do-not-disturb or focus mode. MuteDeck doesn't
+// report it, so the bridge publishes its state to <state topic>/dnd.
+var dndEntity = entity{Key: "dnd", Name: "Do not disturb", Icon: "mdi:minus-circle", Platform: "switch", DeviceClass: "switch", Topic: "dnd"}
+
+// DND status of each device set through the switch, by topic
+var dndStates = make(map[string]string)
+var dndStatesMu sync.Mutex
+
+// Whether DND commands for a device can be delivered
+func dndControllable(topic string) bool {
+	return dndSwitch && (dndCommand != "" || controllable(topic))
+}
+
+// Get the DND status of a device, unknown if it was never set
+func dndStatus(topic string) string {
+	dndStatesMu.Lock()
+	defer dndStatesMu.Unlock()
+	if status, ok := dndStates[topic]; ok {
+		return status
+	}
+	return unknownValue
+}
+
+// Set a device's DND through DND_COMMAND, its MuteDeck API, its callback or
+// its mailbox, then publish the new state
+func setDND(topic string, status string) error {
+	on := "off"
+	if status == "active" {
+		on = "on"
+	}
+	pending := pendingCommand{Topic: topic, Key: dndEntity.Key, Command: status, Time: time.Now().UTC().Format(time.RFC3339)}
+
+	var err error
+	switch {
+	case strings.HasPrefix(dndCommand, "http://") || strings.HasPrefix(dndCommand, "https://"):
+		err = postCallback(dndCommand, pending)
+	case dndCommand != "":
+		err = runDNDScript(topic, on)
+	default:
+		if base, ok := muteDeckAPIs[topic]; ok {
+			err = callMuteDeckAPI(base, "dnd/"+on)
+		} else if callback := callbackFor(topic); callback != "" {
+			err = postCallback(callback, pending)
+		} else {
+			queueCommand(pending)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	dndStatesMu.Lock()
+	dndStates[topic] = status
+	dndStatesMu.Unlock()
+
+	stateTopic := dndStateTopic(topic)
+	if stateTopic == "" {
+		return nil
+	}
+	payload := "OFF"
+	if status == "active" {
+		payload = "ON"
+	}
+	return publish(stateTopic, 0, true, []byte(payload))
+}
+
+// Run the DND script with the device's topic and on or off
+func runDNDScript(topic string, on string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dndCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, dndCommand, topic, on).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", dndCommand, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Get the state topic of a device's DND switch, empty if it wasn't announced
+func dndStateTopic(topic string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, payload := range discoveryMessages {
+		if component, ok := payload.Components[fmt.Sprintf("%s_%s", deviceIDOf(topic), dndEntity.Key)]; ok {
+			return component.StateTopic
+		}
+	}
+	return ""
+}
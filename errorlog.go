@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// An error kept in the recent errors
+type RecentError struct {
+	Time    string `json:"time"`
+	Kind    string `json:"kind"`
+	Topic   string `json:"topic,omitempty"`
+	Message string `json:"message"`
+}
+
+// The most recent errors, oldest first, and how many are kept. Zero keeps
+// none.
+var recentErrors []RecentError
+var recentErrorsSize = 20
+var recentErrorsMu sync.Mutex
+
+// Remember an error, dropping the oldest once recentErrorsSize are kept.
+// kind is what failed, like "publish", "validation" or "connection".
+func recordRecentError(kind string, topic string, message string) {
+	if recentErrorsSize <= 0 {
+		return
+	}
+
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	if len(recentErrors) >= recentErrorsSize {
+		recentErrors = append(recentErrors[:0], recentErrors[len(recentErrors)-recentErrorsSize+1:]...)
+	}
+	recentErrors = append(recentErrors, RecentError{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Kind:    kind,
+		Topic:   topic,
+		Message: message,
+	})
+}
+
+// Get the recent errors, newest first
+func recentErrorList() []RecentError {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	list := make([]RecentError, len(recentErrors))
+	for i, e := range recentErrors {
+		list[len(recentErrors)-1-i] = e
+	}
+	return list
+}
+
+// Serve the recent errors with GET /errors, newest first, so transient
+// faults can be looked at after the fact. ?kind= only returns errors of one
+// kind.
+func handleErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := recentErrorList()
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		filtered := list[:0]
+		for _, e := range list {
+			if e.Kind == kind {
+				filtered = append(filtered, e)
+			}
+		}
+		list = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
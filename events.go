@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Serve published states as Server-Sent Events on /events
+var eventsEnabled = false
+
+// How often a comment is sent to keep idle streams open through proxies
+const eventsKeepAliveInterval = 30 * time.Second
+
+// Closed when the server shuts down to end the streams, which would otherwise
+// hold up the shutdown
+var eventsStop = make(chan struct{})
+
+// Stream published states as Server-Sent Events with GET /events, starting
+// with the last state of every device. Each state is a "state" event with
+// the same JSON as /ws. ?topic= only streams one device.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	// The server's write timeout is meant for requests, not a long lived
+	// stream
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		logRequest(r, ERROR, "Error streaming events", "error", err)
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// Tell clients how long to wait before reconnecting
+	fmt.Fprint(w, "retry: 5000\n\n")
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	subscriber := subscribeStates(r.URL.Query().Get("topic"))
+	defer unsubscribeStates(subscriber)
+	logRequest(r, DEBUG, "Event stream client connected")
+	defer logRequest(r, DEBUG, "Event stream client disconnected")
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case message, ok := <-subscriber.send:
+			if !ok {
+				logRequest(r, WARN, "Event stream client fell behind, disconnecting it")
+				return
+			}
+			// The JSON never contains newlines, so it fits on one data line
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", message)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-eventsStop:
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
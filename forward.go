@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// URLs every published state is forwarded to, the template building the
+// request body, nil to send the state as JSON, and its content type
+var forwardURLs []string
+var forwardTemplate *template.Template
+var forwardContentType = "application/json"
+
+// How often a forward is retried, waiting 1s, 2s, 4s, ... in between
+var forwardRetries = 3
+
+// Forwards queued per URL and device so each URL gets a device's states in
+// order
+var forwardQueue *deviceQueue
+
+// Parse a comma separated list of forward URLs
+func parseForwardURLs(list string) ([]string, error) {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if err := validateOutboundURL(u); err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// Build the body a state is forwarded with. The template gets the state's
+// fields along with topic and state_topic.
+func forwardBody(u stateUpdate) ([]byte, error) {
+	data := u.state.fields()
+	data["topic"] = u.topic
+	data["state_topic"] = u.fullTopic
+	if forwardTemplate == nil {
+		return json.Marshal(data)
+	}
+
+	var buf bytes.Buffer
+	if err := forwardTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Queue a published state to be forwarded to every forward URL
+func forwardState(u stateUpdate) {
+	if len(forwardURLs) == 0 {
+		return
+	}
+
+	body, err := forwardBody(u)
+	if err != nil {
+		logMessage(ERROR, "Error applying forward template", "error", err)
+		return
+	}
+	for _, target := range forwardURLs {
+		target := target
+		if !forwardQueue.enqueue(target+" "+u.fullTopic, func() { sendForward(target, u.topic, body) }) {
+			logMessage(WARN, "Forward queue is full, dropping state", "topic", u.topic, "target", target)
+		}
+	}
+}
+
+// Post a forwarded state, retrying with a growing delay
+func sendForward(target string, topic string, body []byte) {
+	err := retry(context.Background(), backoff{initial: time.Second, retries: forwardRetries}, "forwarding state", func() error {
+		return postForward(target, body)
+	}, "topic", topic, "target", target)
+	if err != nil {
+		logMessage(ERROR, "Error forwarding state", "topic", topic, "target", target, "error", err)
+		recordRecentError("forward", topic, fmt.Sprintf("%s: %v", target, err))
+		return
+	}
+	logMessage(DEBUG, "Forwarded state", "topic", topic, "target", target)
+}
+
+func postForward(target string, body []byte) error {
+	req, err := newOutboundRequest(http.MethodPost, target, forwardContentType, body)
+	if err != nil {
+		return err
+	}
+	return sendOutbound(req, serviceTimeout, nil)
+}
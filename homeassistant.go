@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Home Assistant instance states are pushed to over its REST API instead of
+// publishing them to MQTT, empty to use MQTT, and the long-lived access token
+// used for it
+var homeAssistantURL = ""
+var homeAssistantToken = ""
+
+// Whether Home Assistant answered the last request, for /readyz
+var homeAssistantReachable atomic.Bool
+
+// Characters Home Assistant doesn't allow in an entity ID
+var entityIDInvalid = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// Entity ID of a device's field, <domain>.<topic>_<field>. MQTT discovery
+// derives entity IDs from the device and entity names instead, so they
+// usually differ and automations need updating when switching between the
+// two.
+func homeAssistantEntityID(topic string, e entity) string {
+	domain := e.Platform
+	// Selects can't be created over the REST API, the platform is shown as
+	// a sensor instead
+	if domain != "binary_sensor" {
+		domain = "sensor"
+	}
+	objectID := strings.Trim(entityIDInvalid.ReplaceAllString(strings.ToLower(fmt.Sprintf("%s_%s", topic, e.Key)), "_"), "_")
+	return fmt.Sprintf("%s.%s", domain, objectID)
+}
+
+// The state Home Assistant shows for a field, on or off for binary sensors
+func homeAssistantEntityState(e entity, value string) string {
+	switch {
+	case value == unknownValue:
+		return "unknown"
+	case e.Platform != "binary_sensor":
+		return value
+	case (value == "active") != e.Inverted:
+		return "on"
+	}
+	return "off"
+}
+
+// Requests setting a device's entities that are sent at once
+const homeAssistantConcurrency = 4
+
+// How often Home Assistant is checked in the background
+var homeAssistantCheckInterval = 30 * time.Second
+
+// Push a device's state to Home Assistant, setting an entity for every field
+// MuteDeck sent. Home Assistant creates the entities on the first push. The
+// entities are set a few at a time, and one failing doesn't keep the others
+// from being set.
+func pushHomeAssistantState(r *http.Request, u stateUpdate) error {
+	unlock := deviceLocks.lock(u.discoveryTopic)
+	defer unlock()
+
+	learnControlOption(u.state.Control)
+	fields := u.state.fields()
+	var wg sync.WaitGroup
+	var errsMu sync.Mutex
+	var errs []error
+	slots := make(chan struct{}, homeAssistantConcurrency)
+	for _, e := range entities {
+		value, _ := fields[e.Key].(string)
+		if value == "" || u.state.Omit[e.Key] {
+			continue
+		}
+
+		attributes := map[string]interface{}{
+			"friendly_name": fmt.Sprintf("%s %s", toTitleCase(u.topic), topicEnv(fmt.Sprintf("ENTITY_%s_NAME", strings.ToUpper(e.Key)), u.topic, localizedName(e.Key, e.Name))),
+			"icon":          topicEnv(fmt.Sprintf("ENTITY_%s_ICON", strings.ToUpper(e.Key)), u.topic, e.Icon),
+			"state_topic":   u.fullTopic,
+		}
+		if e.DeviceClass != "" {
+			attributes["device_class"] = e.DeviceClass
+		}
+		entityID := homeAssistantEntityID(u.topic, e)
+		state := homeAssistantEntityState(e, value)
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer recoverGoroutine("Home Assistant push")
+			if err := postHomeAssistantState(entityID, state, attributes); err != nil {
+				logRequest(r, ERROR, "Error pushing state to Home Assistant", "topic", u.topic, "entity_id", entityID, "error", err)
+				recordRecentError("publish", u.topic, fmt.Sprintf("%s: %v", entityID, err))
+				errsMu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", entityID, err))
+				errsMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := errors.Join(errs...)
+	stats.recordPublish(err)
+	recordPublished(u, err)
+	if err != nil {
+		return err
+	}
+
+	stateData, err := json.Marshal(u.state)
+	if err != nil {
+		logRequest(r, ERROR, "Error marshaling JSON data", "error", err)
+		return err
+	}
+	statePublished(u, stateData)
+	logRequest(r, INFO, "Pushed state to Home Assistant", "topic", u.topic, "payload", string(stateData))
+	return nil
+}
+
+// Set an entity's state with POST /api/states/{entity_id}
+func postHomeAssistantState(entityID string, state string, attributes map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"state": state, "attributes": attributes})
+	if err != nil {
+		return err
+	}
+	req, err := newOutboundRequest(http.MethodPost, homeAssistantAPI("states/"+entityID), "application/json", body)
+	if err != nil {
+		return err
+	}
+	return doHomeAssistant(req)
+}
+
+// Check that Home Assistant can be reached and accepts the token
+func checkHomeAssistant() error {
+	req, err := http.NewRequest(http.MethodGet, homeAssistantAPI(""), nil)
+	if err != nil {
+		return err
+	}
+	return doHomeAssistant(req)
+}
+
+func homeAssistantAPI(path string) string {
+	return strings.TrimSuffix(homeAssistantURL, "/") + "/api/" + path
+}
+
+// Send a request to Home Assistant with the access token, remembering
+// whether it could be reached
+func doHomeAssistant(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+homeAssistantToken)
+	err := sendOutbound(req, serviceTimeout, nil)
+	var statusErr *statusError
+	homeAssistantReachable.Store(err == nil || (errors.As(err, &statusErr) && statusErr.code != http.StatusUnauthorized))
+	return err
+}
+
+// Check Home Assistant every homeAssistantCheckInterval so /readyz notices
+// when it goes away or comes back between states, logging the changes
+func watchHomeAssistant() {
+	defer recoverGoroutine("Home Assistant check")
+	ticker := time.NewTicker(homeAssistantCheckInterval)
+	defer ticker.Stop()
+	reachable := true
+	for {
+		err := checkHomeAssistant()
+		switch {
+		case err != nil && reachable:
+			logMessage(ERROR, "Error connecting to Home Assistant", "error", err)
+		case err == nil && !reachable:
+			logMessage(INFO, "Home Assistant is reachable again")
+		}
+		reachable = err == nil
+		<-ticker.C
+	}
+}
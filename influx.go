@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// InfluxDB v2 server every published state is written to, empty to not write
+// them, and where they're written
+var influxURL = ""
+var influxToken = ""
+var influxOrg = ""
+var influxBucket = ""
+var influxMeasurement = "mutedeck"
+
+// Points waiting to be written, and how many are written at once
+var influxQueue = make(chan string, 1024)
+
+const influxBatchSize = 500
+
+// Closed to stop the writer, which closes influxDone once it wrote the last
+// points
+var influxStop = make(chan struct{})
+var influxDone = make(chan struct{})
+
+// How often queued points are written
+var influxFlushInterval = 10 * time.Second
+
+// Escape a tag key or value, or a measurement with escapeEquals off, for the
+// line protocol
+func influxEscape(value string, escapeEquals bool) string {
+	value = strings.NewReplacer("\\", "\\\\", ",", "\\,", " ", "\\ ", "\n", "\\n").Replace(value)
+	if escapeEquals {
+		value = strings.ReplaceAll(value, "=", "\\=")
+	}
+	return value
+}
+
+// Queue a published state as a point tagged with its topic and platform,
+// with a boolean field for every status that's known
+func recordInfluxState(topic string, state MuteDeckState) {
+	if influxURL == "" {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(influxEscape(influxMeasurement, false))
+	line.WriteString(",topic=" + influxEscape(topic, true))
+	if state.Control != "" && state.Control != unknownValue {
+		line.WriteString(",control=" + influxEscape(state.Control, true))
+	}
+	var fields []string
+	for _, f := range []struct {
+		key   string
+		value string
+	}{
+		{"call", state.Call},
+		{"in_meeting", state.InMeeting},
+		{"mute", state.Mute},
+		{"record", state.Record},
+		{"share", state.Share},
+		{"video", state.Video},
+	} {
+		if f.value == "" || f.value == unknownValue || state.Omit[f.key] {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s=%t", f.key, f.value == "active"))
+	}
+	if len(fields) == 0 {
+		return
+	}
+	fmt.Fprintf(&line, " %s %d", strings.Join(fields, ","), time.Now().Unix())
+
+	select {
+	case influxQueue <- line.String():
+	default:
+		// Drop points rather than block when InfluxDB is slow
+	}
+}
+
+// Write queued points in batches until influxStop is closed
+func runInfluxWriter(done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(influxFlushInterval)
+	defer ticker.Stop()
+
+	var batch []string
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := writeInfluxPoints(batch); err != nil {
+			logMessage(WARN, "Error writing points to InfluxDB", "count", len(batch), "error", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case line := <-influxQueue:
+			batch = append(batch, line)
+			if len(batch) >= influxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-influxStop:
+			// Write what's still queued
+			for {
+				select {
+				case line := <-influxQueue:
+					batch = append(batch, line)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Write points with the InfluxDB v2 write API
+func writeInfluxPoints(lines []string) error {
+	query := url.Values{"org": {influxOrg}, "bucket": {influxBucket}, "precision": {"s"}}
+	endpoint := strings.TrimSuffix(influxURL, "/") + "/api/v2/write?" + query.Encode()
+	req, err := newOutboundRequest(http.MethodPost, endpoint, "text/plain; charset=utf-8", []byte(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	if influxToken != "" {
+		req.Header.Set("Authorization", "Token "+influxToken)
+	}
+	return sendOutbound(req, serviceTimeout, nil)
+}
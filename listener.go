@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// Open the listener for the HTTP server. A Unix domain socket is used when a
+// socket path is given, otherwise the TCP address.
+func listen(socketPath string, addr string, socketMode os.FileMode) (net.Listener, error) {
+	if socketPath == "" {
+		logMessage(INFO, "Listening", "address", addr)
+		return net.Listen("tcp", addr)
+	}
+
+	// Remove a socket left behind by a previous run
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, socketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	logMessage(INFO, "Listening on Unix socket", "path", socketPath)
+	return listener, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Language of the entity names in discovery messages, English by default
+var entityLanguage = "en"
+
+// Translated entity names by language and entity key. Entities missing from a
+// language keep their English name.
+var entityNames = map[string]map[string]string{
+	"de": {
+		"call":                      "Anruf",
+		"control":                   "Steuerung",
+		"mute":                      "Mikrofon",
+		"record":                    "Aufnahme",
+		"share":                     "Bildschirmfreigabe",
+		"video":                     "Video",
+		"in_meeting":                "In Besprechung",
+		"hand":                      "Hand gehoben",
+		"speaker":                   "Lautsprecher",
+		"meeting_started_at":        "Besprechungsbeginn",
+		"meeting_duration":          "Besprechungsdauer",
+		"meeting":                   "Besprechung",
+		"last_seen":                 "Zuletzt gesehen",
+		"leave":                     "Besprechung verlassen",
+		"reannounce":                "Neu ankündigen",
+		"dnd":                       "Nicht stören",
+		"anyone_in_meeting":         "Jemand in einer Besprechung",
+		"bridge_connected":          "Verbunden",
+		"bridge_uptime":             "Betriebszeit",
+		"bridge_version":            "Version",
+		"bridge_devices":            "Geräte",
+		"bridge_messages_published": "Gesendete Nachrichten",
+		"bridge_last_error":         "Letzter Fehler",
+		"bridge_recent_errors":      "Letzte Fehler",
+	},
+	"fr": {
+		"call":                      "Appel",
+		"control":                   "Contrôle",
+		"mute":                      "Microphone",
+		"record":                    "Enregistrement",
+		"share":                     "Partage d'écran",
+		"video":                     "Vidéo",
+		"in_meeting":                "En réunion",
+		"hand":                      "Main levée",
+		"speaker":                   "Haut-parleur",
+		"meeting_started_at":        "Début de la réunion",
+		"meeting_duration":          "Durée de la réunion",
+		"meeting":                   "Réunion",
+		"last_seen":                 "Vu pour la dernière fois",
+		"leave":                     "Quitter la réunion",
+		"reannounce":                "Réannoncer",
+		"dnd":                       "Ne pas déranger",
+		"anyone_in_meeting":         "Quelqu'un en réunion",
+		"bridge_connected":          "Connecté",
+		"bridge_uptime":             "Temps de fonctionnement",
+		"bridge_version":            "Version",
+		"bridge_devices":            "Appareils",
+		"bridge_messages_published": "Messages publiés",
+		"bridge_last_error":         "Dernière erreur",
+		"bridge_recent_errors":      "Erreurs récentes",
+	},
+	"nl": {
+		"call":                      "Gesprek",
+		"control":                   "Bediening",
+		"mute":                      "Microfoon",
+		"record":                    "Opname",
+		"share":                     "Scherm delen",
+		"video":                     "Video",
+		"in_meeting":                "In vergadering",
+		"hand":                      "Hand opgestoken",
+		"speaker":                   "Luidspreker",
+		"meeting_started_at":        "Begin vergadering",
+		"meeting_duration":          "Duur vergadering",
+		"meeting":                   "Vergadering",
+		"last_seen":                 "Laatst gezien",
+		"leave":                     "Vergadering verlaten",
+		"reannounce":                "Opnieuw aankondigen",
+		"dnd":                       "Niet storen",
+		"anyone_in_meeting":         "Iemand in vergadering",
+		"bridge_connected":          "Verbonden",
+		"bridge_uptime":             "Uptime",
+		"bridge_version":            "Versie",
+		"bridge_devices":            "Apparaten",
+		"bridge_messages_published": "Verzonden berichten",
+		"bridge_last_error":         "Laatste fout",
+		"bridge_recent_errors":      "Recente fouten",
+	},
+	"es": {
+		"call":                      "Llamada",
+		"control":                   "Control",
+		"mute":                      "Micrófono",
+		"record":                    "Grabación",
+		"share":                     "Compartir pantalla",
+		"video":                     "Vídeo",
+		"in_meeting":                "En reunión",
+		"hand":                      "Mano levantada",
+		"speaker":                   "Altavoz",
+		"meeting_started_at":        "Inicio de la reunión",
+		"meeting_duration":          "Duración de la reunión",
+		"meeting":                   "Reunión",
+		"last_seen":                 "Visto por última vez",
+		"leave":                     "Salir de la reunión",
+		"reannounce":                "Volver a anunciar",
+		"dnd":                       "No molestar",
+		"anyone_in_meeting":         "Alguien en una reunión",
+		"bridge_connected":          "Conectado",
+		"bridge_uptime":             "Tiempo de actividad",
+		"bridge_version":            "Versión",
+		"bridge_devices":            "Dispositivos",
+		"bridge_messages_published": "Mensajes publicados",
+		"bridge_last_error":         "Último error",
+		"bridge_recent_errors":      "Errores recientes",
+	},
+}
+
+// Parse ENTITY_LANGUAGE, accepting tags like de-DE or de_AT for the language
+func parseEntityLanguage(value string) (string, error) {
+	language := strings.ToLower(strings.TrimSpace(value))
+	if i := strings.IndexAny(language, "-_"); i >= 0 {
+		language = language[:i]
+	}
+	if _, ok := entityNames[language]; !ok && language != "en" {
+		languages := []string{"en"}
+		for l := range entityNames {
+			languages = append(languages, l)
+		}
+		sort.Strings(languages)
+		return "", fmt.Errorf("unsupported language %q, expected one of: %s", value, strings.Join(languages, ", "))
+	}
+	return language, nil
+}
+
+// Get an entity's name in the configured language
+func localizedName(key string, name string) string {
+	if translated, ok := entityNames[entityLanguage][key]; ok {
+		return translated
+	}
+	return name
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutexSerializesAKey(t *testing.T) {
+	locks := newKeyedMutex()
+	var running, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.lock("homeassistant/device/laptop/config")
+			defer unlock()
+			n := atomic.AddInt32(&running, 1)
+			if n > atomic.LoadInt32(&most) {
+				atomic.StoreInt32(&most, n)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Errorf("%d holders of the same key at once, want 1", most)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left after unlocking, want 0", len(locks.locks))
+	}
+}
+
+func TestKeyedMutexOtherKeysDontWait(t *testing.T) {
+	locks := newKeyedMutex()
+	unlock := locks.lock("laptop")
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		locks.lock("desktop")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("locking another key waited for the held one")
+	}
+}
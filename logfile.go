@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where logs are written, stderr unless LOG_FILE is set
+var logOutput io.Writer = os.Stderr
+
+// Suffix of rotated log files, the time of the rotation
+const logBackupLayout = "20060102-150405.000"
+
+// Log file rotated once it reaches maxSize bytes or is maxAge old. Rotated
+// files get the time of the rotation as a suffix, like
+// mutedeck2mqtt.log.20241216-093000.000, and only the newest maxBackups are kept.
+// The age counts from when the file was created.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Open a log file, appending to it if it exists
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), fileCreated(f.path, info)
+	if info.Size() == 0 {
+		f.opened = time.Now()
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if (f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize) || (f.maxAge > 0 && time.Since(f.opened) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "Error rotating log file %s: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Move the current file aside, start a new one and remove the oldest backups
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.%s", f.path, time.Now().Format(logBackupLayout))
+	if err := os.Rename(f.path, backup); err != nil {
+		// Reopen so the next write doesn't hit a closed file
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	backups, err := f.backups()
+	if err != nil || len(backups) <= f.maxBackups {
+		return err
+	}
+	// The timestamps sort chronologically
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-f.maxBackups] {
+		os.Remove(old)
+	}
+	return nil
+}
+
+// Paths of the rotated files. Only names with a rotation time as their
+// suffix count, so other files next to the log, like mutedeck2mqtt.log.gz,
+// are never removed.
+func (f *rotatingFile) backups() ([]string, error) {
+	dir := filepath.Dir(f.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(f.path) + "."
+	var backups []string
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		if _, err := time.Parse(logBackupLayout, suffix); err == nil {
+			backups = append(backups, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return backups, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// When a file was created. Other systems don't tell, so the modification
+// time stands in for it.
+func fileCreated(path string, info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Handler passing each record, with its attributes flattened to key/value
+// pairs, to a logging backend like syslog or the journal
+type sinkHandler struct {
+	emit  func(level slog.Level, message string, attrs []slog.Attr) error
+	attrs []slog.Attr
+	group string
+}
+
+func (h *sinkHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *sinkHandler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, flattenAttr(h.group, a)...)
+		return true
+	})
+	return h.emit(r.Level, r.Message, attrs)
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		handler.attrs = append(handler.attrs, flattenAttr(h.group, a)...)
+	}
+	return &handler
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	handler := *h
+	handler.group = h.group + name + "."
+	return &handler
+}
+
+// Flatten an attribute, prefixing the keys of groups with their name
+func flattenAttr(prefix string, a slog.Attr) []slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() != slog.KindGroup {
+		if a.Key == "" {
+			return nil
+		}
+		return []slog.Attr{{Key: prefix + a.Key, Value: a.Value}}
+	}
+	if a.Key != "" {
+		prefix += a.Key + "."
+	}
+	var attrs []slog.Attr
+	for _, member := range a.Value.Group() {
+		attrs = append(attrs, flattenAttr(prefix, member)...)
+	}
+	return attrs
+}
+
+// Format a message and its attributes as one key=value line
+func formatLogLine(message string, attrs []slog.Attr) string {
+	var b strings.Builder
+	b.WriteString(message)
+	for _, a := range attrs {
+		value := a.Value.String()
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", a.Key, value)
+	}
+	return b.String()
+}
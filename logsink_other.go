@@ -0,0 +1,16 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+func newSyslogHandler(address string) (slog.Handler, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func newJournalHandler() (slog.Handler, error) {
+	return nil, errors.New("the systemd journal is not supported on this platform")
+}
@@ -0,0 +1,108 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+// Socket of the systemd journal's native protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// Log to syslog with the daemon facility, locally or to a remote server at
+// an address like udp://logs.local:514
+func newSyslogHandler(address string) (slog.Handler, error) {
+	var network, raddr string
+	if address != "" {
+		var ok bool
+		network, raddr, ok = strings.Cut(address, "://")
+		if !ok || (network != "udp" && network != "tcp") || raddr == "" {
+			return nil, fmt.Errorf("expected udp://host:port or tcp://host:port, got %q", address)
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, "mutedeck2mqtt")
+	if err != nil {
+		return nil, err
+	}
+	return &sinkHandler{emit: func(level slog.Level, message string, attrs []slog.Attr) error {
+		line := formatLogLine(message, attrs)
+		switch {
+		case level >= ERROR:
+			return w.Err(line)
+		case level >= WARN:
+			return w.Warning(line)
+		case level >= INFO:
+			return w.Info(line)
+		}
+		return w.Debug(line)
+	}}, nil
+}
+
+// Log to the systemd journal. Attributes become journal fields, so lines can
+// be filtered with e.g. journalctl REQUEST_ID=... or TOPIC=...
+func newJournalHandler() (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &sinkHandler{emit: func(level slog.Level, message string, attrs []slog.Attr) error {
+		var b bytes.Buffer
+		writeJournalField(&b, "MESSAGE", message)
+		writeJournalField(&b, "PRIORITY", fmt.Sprint(journalPriority(level)))
+		writeJournalField(&b, "SYSLOG_IDENTIFIER", "mutedeck2mqtt")
+		for _, a := range attrs {
+			if name := journalFieldName(a.Key); name != "" {
+				writeJournalField(&b, name, a.Value.String())
+			}
+		}
+		_, err := conn.Write(b.Bytes())
+		return err
+	}}, nil
+}
+
+// Syslog priority of a log level
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= ERROR:
+		return 3
+	case level >= WARN:
+		return 4
+	case level >= INFO:
+		return 6
+	}
+	return 7
+}
+
+// Turn an attribute key into a journal field name, which may only have
+// uppercase letters, digits and underscores and can't start with one
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	return strings.TrimLeft(string(name), "_0123456789")
+}
+
+// Write a field in the journal's native format. Values with newlines are
+// written with their length instead of being terminated by one.
+func writeJournalField(b *bytes.Buffer, name string, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"golang.org/x/text/cases"
@@ -21,46 +32,176 @@ import (
 // Constants
 const (
 	object_id = "mutedeck2mqtt_device"
+	version   = "2024.12.16"
+)
 
-	DEBUG = iota
-	INFO
-	WARN
-	ERROR
+// Log levels
+const (
+	DEBUG = slog.LevelDebug
+	INFO  = slog.LevelInfo
+	WARN  = slog.LevelWarn
+	ERROR = slog.LevelError
 )
 
-// Global variable to store the current log level
-var logLevel = INFO
+// Current log level, changed at runtime through setLogLevel
+var logLevel = new(slog.LevelVar)
+
+// Structured logger, logging text or, with LOG_FORMAT=json, JSON lines
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// Prefix for Home Assistant discovery topics
+var discovery_prefix string
+
+// Retain discovery messages so entities survive a Home Assistant restart
+var discoveryRetain = true
+
+// QoS of discovery messages and how often publishing one is retried before
+// giving up
+var discoveryQoS byte = 1
+var discoveryRetries = 3
+
+// Template used to build the state topic
+var stateTopicTemplate = "{prefix}/{topic}"
+
+// Retain state messages and optionally expire them after an interval
+var stateRetain = false
+var stateExpiry time.Duration
+
+// How states are published: "json" as one JSON message, "fields" as one
+// topic per field, or "both"
+var stateFormat = "json"
+
+// Prefix of the retained flat busy topics, e.g. busy/laptop = true, empty to
+// not publish them
+var flatTopicPrefix = ""
+
+// Flat topic last published for each state topic, so it's cleared with it
+var flatTopics = make(map[string]string)
+var flatTopicsMu sync.Mutex
+
+// Only publish states that changed, unless the last publish is older than
+// the refresh interval
+var deduplicateStates = false
+var deduplicateRefresh time.Duration
+
+// Add last_updated and seq to published states
+var stateMetadata = false
+
+// Sequence number of the last published state
+var stateSeq uint64
+
+// Timers that clear retained states which haven't been refreshed, and that
+// reset the outputs of devices whose state expired, by MQTT topic
+var expiryTimers = make(map[string]*time.Timer)
+var deviceExpiryTimers = make(map[string]*time.Timer)
+var expiryMu sync.Mutex
 
 // Map to store successfully sent discovery topics
 var discoveryTopics = make(map[string]bool)
 var mu sync.Mutex
 
-// Custom logger function
-func logMessage(level int, message string) {
-	if level >= logLevel {
-		var levelStr string
-		switch level {
-		case DEBUG:
-			levelStr = "DEBUG"
-		case INFO:
-			levelStr = "INFO"
-		case WARN:
-			levelStr = "WARN"
-		case ERROR:
-			levelStr = "ERROR"
+// Locks serializing requests per device
+var deviceLocks = newKeyedMutex()
+
+// Only publish the last state of a burst of webhooks for a device
+var stateDebouncer *debouncer
+
+// Publish in the background and answer webhooks with 202 Accepted
+var asyncPublish = false
+var publishQueue *deviceQueue
+
+// Level names by level
+var logLevelNames = map[slog.Level]string{DEBUG: "DEBUG", INFO: "INFO", WARN: "WARN", ERROR: "ERROR"}
+
+// Parse a log level name like debug or WARN
+func parseLogLevel(name string) (slog.Level, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(strings.TrimSpace(name), levelName) {
+			return level, nil
 		}
-		log.Printf("[%s] %s\n", levelStr, message)
 	}
+	return 0, fmt.Errorf("unknown log level %q, expected DEBUG, INFO, WARN or ERROR", name)
+}
+
+func setLogLevel(level slog.Level) {
+	logLevel.Set(level)
+}
+
+// Set up the logger for a LOG_FORMAT of text or json. Messages of the log
+// package go through it too.
+func setLogFormat(format string) error {
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(logOutput, options))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(logOutput, options))
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Send logs to syslog or the journal for a LOG_OUTPUT of syslog or journal,
+// replacing the log format. stderr keeps the logger set up by setLogFormat.
+func setLogOutput(output string, syslogAddress string) error {
+	var handler slog.Handler
+	var err error
+	switch strings.ToLower(strings.TrimSpace(output)) {
+	case "stderr":
+		return nil
+	case "syslog":
+		handler, err = newSyslogHandler(syslogAddress)
+	case "journal":
+		handler, err = newJournalHandler()
+	default:
+		return fmt.Errorf("unknown log output %q, expected stderr, syslog or journal", output)
+	}
+	if err != nil {
+		return err
+	}
+	logger = slog.New(handler)
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Log a message with optional key/value pairs like "topic", topic
+func logMessage(level slog.Level, message string, args ...any) {
+	logger.Log(context.Background(), level, message, args...)
 }
 
-// Function to get the client's IP address
+// Proxies allowed to set X-Forwarded-For
+var trustedProxies []*net.IPNet
+
+// Function to get the client's IP address. X-Forwarded-For is only honored
+// when the direct peer is a trusted proxy, or a local process connected
+// through the Unix socket.
 func getClientIP(r *http.Request) string {
 	forwarded := r.Header.Get("X-FORWARDED-FOR")
-	if forwarded != "" {
-		// If there are multiple IPs, take the first one
-		return strings.Split(forwarded, ",")[0]
+	if forwarded == "" {
+		return r.RemoteAddr
+	}
+	if peer := parseIP(r.RemoteAddr); peer != nil && !containsIP(trustedProxies, peer) {
+		return r.RemoteAddr
+	}
+
+	// Walk back from the nearest hop and take the first untrusted address,
+	// skipping empty hops of a malformed header. A hop that isn't an address
+	// is taken as is, and doesn't match any allowed network.
+	hops := strings.Split(forwarded, ",")
+	client := r.RemoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		client = hop
+		if !containsIP(trustedProxies, parseIP(hop)) {
+			break
+		}
 	}
-	return r.RemoteAddr
+	return client
 }
 
 func getPlatformName(input string) string {
@@ -86,6 +227,183 @@ func toTitleCase(s string) string {
 	return caser.String(s)
 }
 
+// Informational page for browsers visiting the webhook URL
+const infoPage = `<!DOCTYPE html>
+<html>
+<head><title>MuteDeck2MQTT</title></head>
+<body>
+<h1>MuteDeck2MQTT %s</h1>
+<p>This bridge accepts MuteDeck webhooks as POST requests and publishes them to MQTT.</p>
+<p>See the <a href="https://github.com/chelming/mutedeck2mqtt/">documentation</a> for setup instructions.</p>
+</body>
+</html>
+`
+
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, infoPage, version)
+}
+
+// Prefix of state topics when a request doesn't name one
+const defaultPrefix = "mutedeck2mqtt"
+
+// Header naming the device when no topic is given
+var topicHeader = "X-Hostname"
+
+// Derive the topic from the client's reverse DNS name as a last resort
+var topicFromReverseDNS = false
+
+// Get the MQTT prefix and topic for a request. They are taken from the
+// payload's topic and prefix fields for a state in a batch, a
+// /webhook/{topic} or /webhook/{prefix}/{topic} path, or the prefix and topic
+// query parameters, in that order. Without a topic it is derived
+// from the device's hostname.
+func getTopic(r *http.Request, state MuteDeckState, batch bool) (string, string) {
+	prefix := r.URL.Query().Get("prefix")
+	topic := r.URL.Query().Get("topic")
+
+	// Invalid paths are rejected before a state is parsed
+	if pathPrefix, pathTopic, err := webhookPath(r.URL.Path); err == nil && pathTopic != "" {
+		topic = pathTopic
+		if pathPrefix != "" {
+			prefix = pathPrefix
+		}
+	}
+
+	// States in a batch name their own topic. A single state's request
+	// names it, so a payload can't redirect a request that was only allowed
+	// to publish to its URL's topic.
+	if batch {
+		if value, ok := state.Extra["topic"].(string); ok && value != "" {
+			topic = value
+		}
+		if value, ok := state.Extra["prefix"].(string); ok && value != "" {
+			prefix = value
+		}
+	}
+
+	if topic == "" {
+		topic = deriveTopic(r, state)
+	}
+	if topic == "" {
+		topic = "mutedeck"
+	}
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return prefix, topic
+}
+
+// Webhook paths with an empty level, and with more levels than a prefix and
+// a topic
+var errEmptyPathLevel = errors.New("empty topic level in path")
+var errTooManyPathLevels = errors.New("expected /webhook/{topic} or /webhook/{prefix}/{topic}")
+
+// Split a /webhook/{topic} or /webhook/{prefix}/{topic} path. Other paths,
+// like /, name no topic.
+func webhookPath(path string) (string, string, error) {
+	rest, ok := strings.CutPrefix(path, "/webhook/")
+	if !ok || rest == "" {
+		return "", "", nil
+	}
+	// A trailing slash is fine, /webhook// has an empty level though
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	for _, part := range parts {
+		if part == "" {
+			return "", "", errEmptyPathLevel
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return "", parts[0], nil
+	case 2:
+		return parts[0], parts[1], nil
+	}
+	return "", "", errTooManyPathLevels
+}
+
+// Get the discovery prefix a device is announced under from the payload or
+// the URL parameters, the configured one by default
+func getDiscoveryPrefix(r *http.Request, state MuteDeckState) string {
+	if value, ok := state.Extra["discovery_prefix"].(string); ok && value != "" {
+		return value
+	}
+	if value := r.URL.Query().Get("discovery_prefix"); value != "" {
+		return value
+	}
+	return discovery_prefix
+}
+
+// Derive a topic from the device's hostname, taken from the topic header,
+// the payload's hostname field or the client's reverse DNS name, in that order
+func deriveTopic(r *http.Request, state MuteDeckState) string {
+	if topicHeader != "" {
+		if hostname := r.Header.Get(topicHeader); hostname != "" {
+			return shortHostname(hostname)
+		}
+	}
+	if hostname, ok := state.Extra["hostname"].(string); ok && hostname != "" {
+		return shortHostname(hostname)
+	}
+	if ip := parseIP(getClientIP(r)); topicFromReverseDNS && ip != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+		if err != nil || len(names) == 0 {
+			logRequest(r, DEBUG, "No reverse DNS name", "ip", ip.String(), "error", err)
+			return ""
+		}
+		return shortHostname(names[0])
+	}
+	return ""
+}
+
+// Lowercase a hostname and strip its domain, e.g. Laptop.local becomes laptop
+func shortHostname(hostname string) string {
+	hostname = strings.ToLower(strings.TrimSpace(hostname))
+	hostname, _, _ = strings.Cut(hostname, ".")
+	return hostname
+}
+
+// Pattern for {variable} placeholders in the state topic template
+var templateVariable = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// Build the state topic from a template. {prefix} and {topic} are always
+// available, any other variable is taken from the query string or, failing
+// that, a request header of the same name.
+func buildStateTopic(template string, r *http.Request, prefix string, topic string) (string, error) {
+	var missing []string
+	var invalid error
+	result := templateVariable.ReplaceAllStringFunc(template, func(match string) string {
+		name := match[1 : len(match)-1]
+		switch name {
+		case "prefix":
+			return prefix
+		case "topic":
+			return topic
+		}
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			value = r.Header.Get(name)
+		}
+		if value == "" {
+			missing = append(missing, name)
+			return match
+		}
+		if err := validateTopicLevel(name, value); err != nil && invalid == nil {
+			invalid = err
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing state topic variables: %v", missing)
+	}
+	if invalid != nil {
+		return "", invalid
+	}
+	return result, nil
+}
+
 // Single discovery payload
 type Device struct {
 	IDs             []string `json:"ids"`
@@ -95,6 +413,7 @@ type Device struct {
 	SoftwareVersion string   `json:"sw"`
 	SerialNumber    string   `json:"sn"`
 	HardwareVersion string   `json:"hw"`
+	SuggestedArea   string   `json:"sa,omitempty"`
 }
 
 type Origin struct {
@@ -104,18 +423,34 @@ type Origin struct {
 }
 
 type Component struct {
-	CommandTopic     string   `json:"cmd_t"`
+	CommandTopic     string   `json:"cmd_t,omitempty"`
 	EnabledByDefault bool     `json:"en"`
-	EntityCategory   string   `json:"ent_cat"`
+	EntityCategory   string   `json:"ent_cat,omitempty"`
 	Icon             string   `json:"icon"`
 	Name             string   `json:"name"`
 	ObjectID         string   `json:"obj_id"`
 	Optimistic       bool     `json:"opt"`
-	Options          []string `json:"options"`
-	Platform         string   `json:"p"`
-	StateTopic       string   `json:"stat_t"`
+	Options          []string `json:"options,omitempty"`
+	Platform         string   `json:"p,omitempty"`
+	StateTopic       string   `json:"stat_t,omitempty"`
 	UniqueID         string   `json:"uniq_id"`
-	ValueTemplate    string   `json:"val_tpl"`
+	ValueTemplate    string   `json:"val_tpl,omitempty"`
+	ExpireAfter      int      `json:"exp_aft,omitempty"`
+	DeviceClass      string   `json:"dev_cla,omitempty"`
+	Unit             string   `json:"unit_of_meas,omitempty"`
+	EventTypes       []string `json:"evt_typ,omitempty"`
+	// Commands and states of switches
+	PayloadOn  string `json:"pl_on,omitempty"`
+	PayloadOff string `json:"pl_off,omitempty"`
+	StateOn    string `json:"stat_on,omitempty"`
+	StateOff   string `json:"stat_off,omitempty"`
+	// Topic and template of the entity's attributes
+	JSONAttributesTopic    string `json:"json_attr_t,omitempty"`
+	JSONAttributesTemplate string `json:"json_attr_tpl,omitempty"`
+}
+
+type Availability struct {
+	Topic string `json:"t"`
 }
 
 type DiscoveryPayloadStruct struct {
@@ -124,46 +459,81 @@ type DiscoveryPayloadStruct struct {
 	Components       map[string]Component `json:"cmps"`
 	StateTopic       string               `json:"stat_t"`
 	QualityOfService int                  `json:"qos"`
+	Availability     []Availability       `json:"avty,omitempty"`
+	AvailabilityMode string               `json:"avty_mode,omitempty"`
 }
 
 var discoveryMessages = make(map[string]DiscoveryPayloadStruct)
 
 func main() {
 	// Set log level from environment variable
-	logLevelStr := os.Getenv("LOG_LEVEL")
-	switch strings.ToUpper(logLevelStr) {
-	case "DEBUG":
-		logLevel = DEBUG
-	case "INFO":
-		logLevel = INFO
-	case "WARN":
-		logLevel = WARN
-	case "ERROR":
-		logLevel = ERROR
-	default:
-		logLevel = INFO
+	if level, err := parseLogLevel(os.Getenv("LOG_LEVEL")); err == nil {
+		setLogLevel(level)
+	}
+	// Check for LOG_FILE and its rotation
+	if path := os.Getenv("LOG_FILE"); path != "" {
+		maxSize := envInt("LOG_FILE_MAX_SIZE", 10)
+		maxBackups := envInt("LOG_FILE_MAX_BACKUPS", 5)
+		if maxSize < 0 || maxBackups < 0 {
+			log.Fatalf("Invalid LOG_FILE_MAX_SIZE or LOG_FILE_MAX_BACKUPS: must not be negative")
+		}
+		file, err := newRotatingFile(path, int64(maxSize)<<20, envDuration("LOG_FILE_MAX_AGE", 0), maxBackups)
+		if err != nil {
+			log.Fatalf("Invalid LOG_FILE: %v", err)
+		}
+		logOutput = file
+		if envBool("LOG_STDOUT", false) {
+			logOutput = io.MultiWriter(file, os.Stdout)
+		}
+	}
+	if err := setLogFormat(envString("LOG_FORMAT", "text")); err != nil {
+		log.Fatalf("Invalid LOG_FORMAT: %v", err)
+	}
+	if err := setLogOutput(envString("LOG_OUTPUT", "stderr"), os.Getenv("LOG_SYSLOG_ADDRESS")); err != nil {
+		log.Fatalf("Invalid LOG_OUTPUT: %v", err)
+	}
+
+	// Check for proxies allowed to forward client addresses
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		nets, err := parseCIDRs(proxies)
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+		trustedProxies = nets
 	}
 
 	// Check for required environment variables
 	var missingVars []string
 
+	// Check for HOME_ASSISTANT_URL, which pushes states to Home Assistant's
+	// REST API instead of MQTT so no broker is needed
+	if homeAssistantURL = os.Getenv("HOME_ASSISTANT_URL"); homeAssistantURL != "" {
+		if err := validateOutboundURL(homeAssistantURL); err != nil {
+			log.Fatalf("Invalid HOME_ASSISTANT_URL: %v", err)
+		}
+		if homeAssistantToken = os.Getenv("HOME_ASSISTANT_TOKEN"); homeAssistantToken == "" {
+			missingVars = append(missingVars, "HOME_ASSISTANT_TOKEN")
+		}
+		logMessage(INFO, "Pushing states to Home Assistant", "url", homeAssistantURL)
+	}
+
 	// Check for MQTT_HOST
 	MQTT_HOST := os.Getenv("MQTT_HOST")
-	if MQTT_HOST == "" {
+	if MQTT_HOST == "" && homeAssistantURL == "" {
 		missingVars = append(missingVars, "MQTT_HOST")
-	} else {
-		logMessage(INFO, fmt.Sprintf("Using MQTT server: %s", MQTT_HOST))
+	} else if homeAssistantURL == "" {
+		logMessage(INFO, "Using MQTT server", "host", MQTT_HOST)
 	}
 
-	// Check for MQTT_PASS
-	MQTT_PASS := os.Getenv("MQTT_PASS")
-	if MQTT_PASS == "" {
+	// Check for MQTT_PASS, MQTT_PASS_FILE or MQTT_PASS_COMMAND
+	credentials := credentialsFromEnv("MQTT")
+	if !passwordConfigured("MQTT") && homeAssistantURL == "" {
 		missingVars = append(missingVars, "MQTT_PASS")
 	}
 
 	// Check for MQTT_USER
 	MQTT_USER := os.Getenv("MQTT_USER")
-	if MQTT_USER == "" {
+	if MQTT_USER == "" && homeAssistantURL == "" {
 		missingVars = append(missingVars, "MQTT_USER")
 	}
 
@@ -183,274 +553,1557 @@ func main() {
 	}
 
 	// Check for a discovery prefix
-	discovery_prefix := os.Getenv("HOME_ASSISTANT_DISCOVERY_TOPIC")
+	discovery_prefix = os.Getenv("HOME_ASSISTANT_DISCOVERY_TOPIC")
 	if discovery_prefix == "" {
 		discovery_prefix = "homeassistant"
 	}
 
-	// Set client identifier
-	clientID := os.Getenv("MQTT_CLIENT_ID")
-	if clientID == "" {
-		clientID = "mutedeck2mqtt"
+	// Check whether discovery messages are retained
+	discoveryRetain = envBool("DISCOVERY_RETAIN", discoveryRetain)
+
+	// Check for DISCOVERY_QOS and DISCOVERY_RETRIES
+	switch qos := envInt("DISCOVERY_QOS", int(discoveryQoS)); qos {
+	case 0, 1:
+		discoveryQoS = byte(qos)
+	default:
+		log.Fatalf("Invalid DISCOVERY_QOS: expected 0 or 1, got %d", qos)
+	}
+	if discoveryRetries = envInt("DISCOVERY_RETRIES", discoveryRetries); discoveryRetries < 0 {
+		log.Fatalf("Invalid DISCOVERY_RETRIES: %d", discoveryRetries)
+	}
+
+	// Check for PUBLISH_RETRIES and PUBLISH_RETRY_BACKOFF
+	if publishRetries = envInt("PUBLISH_RETRIES", publishRetries); publishRetries < 0 {
+		log.Fatalf("Invalid PUBLISH_RETRIES: %d", publishRetries)
+	}
+	if publishRetryBackoff = envDuration("PUBLISH_RETRY_BACKOFF", publishRetryBackoff); publishRetryBackoff <= 0 {
+		log.Fatalf("Invalid PUBLISH_RETRY_BACKOFF: %s", publishRetryBackoff)
 	}
 
-	// MQTT client options
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", MQTT_HOST, MQTT_PORT))
-	opts.SetClientID(clientID)
-	opts.SetUsername(MQTT_USER)
-	opts.SetPassword(MQTT_PASS)
+	// Check for CIRCUIT_BREAKER_THRESHOLD and CIRCUIT_BREAKER_COOLDOWN
+	if publishCircuit.threshold = envInt("CIRCUIT_BREAKER_THRESHOLD", publishCircuit.threshold); publishCircuit.threshold < 0 {
+		log.Fatalf("Invalid CIRCUIT_BREAKER_THRESHOLD: %d", publishCircuit.threshold)
+	}
+	if publishCircuit.cooldown = envDuration("CIRCUIT_BREAKER_COOLDOWN", publishCircuit.cooldown); publishCircuit.cooldown <= 0 {
+		log.Fatalf("Invalid CIRCUIT_BREAKER_COOLDOWN: %s", publishCircuit.cooldown)
+	}
 
-	// Create and start the MQTT client
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
+	// Check for MQTT_PUBLISH_TIMEOUT
+	if publishTimeout = envDuration("MQTT_PUBLISH_TIMEOUT", publishTimeout); publishTimeout <= 0 {
+		log.Fatalf("Invalid MQTT_PUBLISH_TIMEOUT: %s", publishTimeout)
 	}
 
-	// Subscribe to homeassistant/status topic
-	client.Subscribe("homeassistant/status", 0, func(client mqtt.Client, msg mqtt.Message) {
-		if string(msg.Payload()) == "online" {
-			logMessage(INFO, "Home Assistant is online, resending discovery message")
-			resendDiscoveryMessages(client)
+	// Check for OFFLINE_QUEUE_FILE and load the messages queued by the last run
+	offlineQueueFile = os.Getenv("OFFLINE_QUEUE_FILE")
+	if offlineQueueFile != "" {
+		if offlineQueueSize = envInt("OFFLINE_QUEUE_SIZE", offlineQueueSize); offlineQueueSize <= 0 {
+			log.Fatalf("Invalid OFFLINE_QUEUE_SIZE: %d", offlineQueueSize)
 		}
-	})
+		if err := loadOfflineQueue(offlineQueueFile); err != nil {
+			log.Fatalf("Invalid OFFLINE_QUEUE_FILE: %v", err)
+		}
+	}
 
-	// HTTP server handler
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Get the client's IP address
-		clientIP := getClientIP(r)
-		logMessage(DEBUG, fmt.Sprintf("Request received from IP: %s", clientIP))
+	// Check for DISCOVERY_CACHE_MAX_ENTRIES and DISCOVERY_CACHE_TTL
+	if discoveryCacheMaxEntries = envInt("DISCOVERY_CACHE_MAX_ENTRIES", 0); discoveryCacheMaxEntries < 0 {
+		log.Fatalf("Invalid DISCOVERY_CACHE_MAX_ENTRIES: %d", discoveryCacheMaxEntries)
+	}
+	if discoveryCacheTTL = envDuration("DISCOVERY_CACHE_TTL", 0); discoveryCacheTTL > 0 {
+		go runDiscoveryCacheExpiry()
+	}
 
-		// Read the body
-		body, err := io.ReadAll(r.Body)
+	// Check for DISCOVERY_CACHE_FILE and load the messages saved by the last run
+	discoveryCacheFile = os.Getenv("DISCOVERY_CACHE_FILE")
+	if discoveryCacheFile != "" {
+		if err := loadDiscoveryCache(discoveryCacheFile); err != nil {
+			log.Fatalf("Invalid DISCOVERY_CACHE_FILE: %v", err)
+		}
+	}
+
+	// Check for DISCOVERY_FORMAT
+	discoveryFormat = strings.ToLower(envString("DISCOVERY_FORMAT", discoveryFormat))
+	if discoveryFormat != "device" && discoveryFormat != "entity" {
+		log.Fatalf("Invalid DISCOVERY_FORMAT: %s", discoveryFormat)
+	}
+
+	// Check for ENTITY_CATEGORY
+	if entityCategory = os.Getenv("ENTITY_CATEGORY"); entityCategory != "" && !validEntityCategory(entityCategory) {
+		log.Fatalf("Invalid ENTITY_CATEGORY: expected diagnostic, config or none, got %q", entityCategory)
+	}
+
+	// Check for ENTITY_LANGUAGE
+	if value := os.Getenv("ENTITY_LANGUAGE"); value != "" {
+		language, err := parseEntityLanguage(value)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			log.Fatalf("Invalid ENTITY_LANGUAGE: %v", err)
 		}
+		entityLanguage = language
+	}
 
-		// Print the incoming body
-		logMessage(DEBUG, fmt.Sprintf("Incoming body: %s", string(body)))
+	// Check for CONTROL_OPTIONS and CONTROL_OPTIONS_AUTO
+	if options := parseControlOptions(os.Getenv("CONTROL_OPTIONS")); len(options) > 0 {
+		controlOptions = options
+	}
+	autoControlOptions = envBool("CONTROL_OPTIONS_AUTO", autoControlOptions)
+	learnCachedControlOptions()
+
+	// Check for a state topic template
+	if template := os.Getenv("STATE_TOPIC_TEMPLATE"); template != "" {
+		stateTopicTemplate = template
+	}
+
+	// Check whether state messages should be retained
+	stateRetain = envBool("STATE_RETAIN", false)
+
+	// Check for a retained state expiry interval
+	stateExpiry = envDuration("STATE_EXPIRY", 0)
+	if stateExpiry > 0 && !stateRetain {
+		logMessage(WARN, "STATE_EXPIRY has no effect unless STATE_RETAIN is enabled")
+	}
 
-		// Parse JSON body
-		var data map[string]interface{}
-		err = json.Unmarshal(body, &data)
+	// Check for the keys a payload must contain
+	if keys, ok := os.LookupEnv("REQUIRED_KEYS"); ok {
+		required, err := parseRequiredKeys(keys)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			log.Fatalf("Invalid REQUIRED_KEYS: %v", err)
 		}
+		requiredKeys = required
+	}
 
-		// Validate JSON keys
-		requiredKeys := []string{"call", "control", "mute", "record", "share", "video"}
-		for _, key := range requiredKeys {
-			if _, ok := data[key]; !ok {
-				logMessage(ERROR, fmt.Sprintf("Request from %s missing required key: %s", clientIP, key))
-				http.Error(w, fmt.Sprintf("Missing required key: %s", key), http.StatusBadRequest)
-				return
-			}
+	// Check for additional spellings of the status values
+	if aliases := os.Getenv("STATUS_ALIASES"); aliases != "" {
+		if err := parseStatusAliases(aliases); err != nil {
+			log.Fatalf("Invalid STATUS_ALIASES: %v", err)
 		}
+	}
+
+	// Check whether entities are announced for recognized extra fields
+	discoverExtraFields = envBool("DISCOVER_EXTRA_FIELDS", false)
 
-		// Process the control field through getPlatformName
-		if control, ok := data["control"].(string); ok {
-			data["control"] = getPlatformName(control)
+	// Check for DISCOVERY_DELAY
+	discoveryDelay = envDuration("DISCOVERY_DELAY", discoveryDelay)
+
+	// Check for a debounce window
+	if window := envDuration("DEBOUNCE_WINDOW", 0); window > 0 {
+		stateDebouncer = newDebouncer(window)
+	}
+
+	// Check whether webhooks are published synchronously or in the background
+	switch mode := strings.ToLower(envString("PUBLISH_MODE", "sync")); mode {
+	case "sync":
+	case "async":
+		queueSize := envInt("PUBLISH_QUEUE_SIZE", 64)
+		if queueSize <= 0 {
+			log.Fatalf("Invalid PUBLISH_QUEUE_SIZE: %d", queueSize)
+		}
+		workers := envInt("PUBLISH_WORKERS", 8)
+		if workers <= 0 {
+			log.Fatalf("Invalid PUBLISH_WORKERS: %d", workers)
 		}
+		var dropOldest bool
+		switch full := strings.ToLower(envString("PUBLISH_QUEUE_FULL", "reject")); full {
+		case "reject":
+		case "drop_oldest":
+			dropOldest = true
+		default:
+			log.Fatalf("Invalid PUBLISH_QUEUE_FULL: %s", full)
+		}
+		asyncPublish = true
+		publishQueue = newDeviceQueue(queueSize, workers, dropOldest)
+	default:
+		log.Fatalf("Invalid PUBLISH_MODE: %s", mode)
+	}
 
-		// Get MQTT topic and prefix from URL parameters
-		topic := r.URL.Query().Get("topic")
-		if topic == "" {
-			topic = "mutedeck"
+	// Check for the bridge availability topic
+	availabilityTopic = envString("BRIDGE_AVAILABILITY_TOPIC", availabilityTopic)
+
+	// Check the ENTITY_<KEY>_<FIELD> overrides
+	if err := checkEntityOverrides(); err != nil {
+		log.Fatalf("Invalid entity override: %v", err)
+	}
+
+	// Check for LAST_SEEN
+	lastSeen = envBool("LAST_SEEN", lastSeen)
+
+	// Check for MEETING_TRACKING
+	meetingTracking = envBool("MEETING_TRACKING", meetingTracking)
+
+	// Check for ANYONE_IN_MEETING
+	anyoneInMeeting = envBool("ANYONE_IN_MEETING", anyoneInMeeting)
+	anyoneInMeetingTopic = envString("ANYONE_IN_MEETING_TOPIC", anyoneInMeetingTopic)
+
+	// Check for DISABLED_ENTITIES and DISABLED_ENTITIES_<TOPIC>
+	if err := checkDisabledEntities(); err != nil {
+		log.Fatalf("Invalid disabled entities: %v", err)
+	}
+
+	// Check for ATTRIBUTES_ENTITIES and ATTRIBUTES_TEMPLATE
+	if list := os.Getenv("ATTRIBUTES_ENTITIES"); list != "" {
+		keys, err := parseEntityKeys(list)
+		if err != nil {
+			log.Fatalf("Invalid ATTRIBUTES_ENTITIES: %v", err)
 		}
-		prefix := r.URL.Query().Get("prefix")
-		if prefix == "" {
-			prefix = "mutedeck2mqtt"
+		attributesEntities = keys
+	}
+	attributesTemplate = os.Getenv("ATTRIBUTES_TEMPLATE")
+
+	// Check for DEVICE_AVAILABILITY and ENTITY_EXPIRE_AFTER
+	deviceAvailability = envBool("DEVICE_AVAILABILITY", deviceAvailability)
+	entityExpireAfter = envDuration("ENTITY_EXPIRE_AFTER", entityExpireAfter)
+	if entityExpireAfter < 0 {
+		log.Fatalf("Invalid ENTITY_EXPIRE_AFTER: %s", entityExpireAfter)
+	}
+
+	// Check for DEVICE_TTL and DEVICE_TTL_CLEAR_STATE
+	deviceTTL = envDuration("DEVICE_TTL", deviceTTL)
+	deviceTTLClearState = envBool("DEVICE_TTL_CLEAR_STATE", deviceTTLClearState)
+	if deviceTTL > 0 && !deviceAvailability {
+		log.Fatalf("DEVICE_TTL requires DEVICE_AVAILABILITY")
+	}
+
+	// Check how states are published
+	stateFormat = strings.ToLower(envString("STATE_FORMAT", stateFormat))
+	if stateFormat != "json" && stateFormat != "fields" && stateFormat != "both" {
+		log.Fatalf("Invalid STATE_FORMAT: %s", stateFormat)
+	}
+	flatTopicPrefix = strings.Trim(os.Getenv("FLAT_TOPIC_PREFIX"), "/")
+	if strings.ContainsAny(flatTopicPrefix, "+#") {
+		log.Fatalf("Invalid FLAT_TOPIC_PREFIX: must not contain wildcards")
+	}
+
+	// Check for ALLOWED_PREFIXES
+	if prefixes := os.Getenv("ALLOWED_PREFIXES"); prefixes != "" {
+		allowed, err := parseAllowedPrefixes(prefixes)
+		if err != nil {
+			log.Fatalf("Invalid ALLOWED_PREFIXES: %v", err)
 		}
+		allowedPrefixes = allowed
+	}
 
-		logMessage(DEBUG, "Checking discovery topic")
+	// Check for DISCOVERY_PREFIXES
+	if prefixes := os.Getenv("DISCOVERY_PREFIXES"); prefixes != "" {
+		allowed, err := parseDiscoveryPrefixes(prefixes)
+		if err != nil {
+			log.Fatalf("Invalid DISCOVERY_PREFIXES: %v", err)
+		}
+		allowedDiscoveryPrefixes = allowed
+	}
 
-		discoveryTopic := fmt.Sprintf("%s/%s/%s_%s/config", discovery_prefix, "device", object_id, topic)
-		mu.Lock()
-		if !discoveryTopics[discoveryTopic] {
-			logMessage(DEBUG, "Preparing discovery topic")
-			// Create the discovery message
-			discoveryPayload := DiscoveryPayloadStruct{
-				Device: Device{
-					IDs:          []string{fmt.Sprintf("%s_%s", object_id, topic)},
-					Name:         toTitleCase(topic),
-					Manufacturer: "MuteDeck",
-				},
-				Origin: Origin{
-					Name:            "MuteDeck2MQTT",
-					SoftwareVersion: "2024.12.16",
-					URL:             "https://github.com/chelming/mutedeck2mqtt/",
-				},
-				Components: map[string]Component{
-					fmt.Sprintf("%s_%s", topic, "call"): {
-						CommandTopic:     "mutedeck2mqtt/no-reply",
-						EnabledByDefault: true,
-						EntityCategory:   "diagnostic",
-						Icon:             "mdi:phone",
-						Name:             "Call",
-						ObjectID:         fmt.Sprintf("%s_%s", topic, "call"),
-						Optimistic:       false,
-						Options:          []string{},
-						Platform:         "binary_sensor",
-						StateTopic:       fmt.Sprintf("%s/%s", prefix, topic),
-						UniqueID:         fmt.Sprintf("%s_%s_mutedeck2mqtt", topic, "call"),
-						ValueTemplate:    fmt.Sprintf("{{ value_json.%s != 'active' and 'OFF' or 'ON' }}", "call"),
-					},
-					fmt.Sprintf("%s_%s", topic, "control"): {
-						CommandTopic:     "mutedeck2mqtt/no-reply",
-						EnabledByDefault: true,
-						EntityCategory:   "diagnostic",
-						Icon:             "mdi:application-cog",
-						Name:             "Control",
-						ObjectID:         fmt.Sprintf("%s_%s", topic, "control"),
-						Optimistic:       false,
-						Options:          []string{"Zoom", "Teams", "Google Meet", "StreamYard", "Webex", "System"},
-						Platform:         "select",
-						StateTopic:       fmt.Sprintf("%s/%s", prefix, topic),
-						UniqueID:         fmt.Sprintf("%s_%s_mutedeck2mqtt", topic, "control"),
-						ValueTemplate:    fmt.Sprintf("{{ value_json.%s }}", "control"),
-					},
-					fmt.Sprintf("%s_%s", topic, "mute"): {
-						CommandTopic:     "mutedeck2mqtt/no-reply",
-						EnabledByDefault: true,
-						EntityCategory:   "diagnostic",
-						Icon:             "mdi:microphone",
-						Name:             "Microphone",
-						ObjectID:         fmt.Sprintf("%s_%s", topic, "mute"),
-						Optimistic:       false,
-						Options:          []string{},
-						Platform:         "binary_sensor",
-						StateTopic:       fmt.Sprintf("%s/%s", prefix, topic),
-						UniqueID:         fmt.Sprintf("%s_%s_mutedeck2mqtt", topic, "mute"),
-						ValueTemplate:    fmt.Sprintf("{{ value_json.%s == 'active' and 'OFF' or 'ON' }}", "mute"),
-					},
-					fmt.Sprintf("%s_%s", topic, "record"): {
-						CommandTopic:     "mutedeck2mqtt/no-reply",
-						EnabledByDefault: true,
-						EntityCategory:   "diagnostic",
-						Icon:             "mdi:record-rec",
-						Name:             "Recording",
-						ObjectID:         fmt.Sprintf("%s_%s", topic, "record"),
-						Optimistic:       false,
-						Options:          []string{},
-						Platform:         "binary_sensor",
-						StateTopic:       fmt.Sprintf("%s/%s", prefix, topic),
-						UniqueID:         fmt.Sprintf("%s_%s_mutedeck2mqtt", topic, "record"),
-						ValueTemplate:    fmt.Sprintf("{{ value_json.%s != 'active' and 'OFF' or 'ON' }}", "record"),
-					},
-					fmt.Sprintf("%s_%s", topic, "share"): {
-						CommandTopic:     "mutedeck2mqtt/no-reply",
-						EnabledByDefault: true,
-						EntityCategory:   "diagnostic",
-						Icon:             "mdi:monitor-share",
-						Name:             "Screen sharing",
-						ObjectID:         fmt.Sprintf("%s_%s", topic, "share"),
-						Optimistic:       false,
-						Options:          []string{},
-						Platform:         "binary_sensor",
-						StateTopic:       fmt.Sprintf("%s/%s", prefix, topic),
-						UniqueID:         fmt.Sprintf("%s_%s_mutedeck2mqtt", topic, "share"),
-						ValueTemplate:    fmt.Sprintf("{{ value_json.%s != 'active' and 'OFF' or 'ON' }}", "share"),
-					},
-					fmt.Sprintf("%s_%s", topic, "video"): {
-						CommandTopic:     "mutedeck2mqtt/no-reply",
-						EnabledByDefault: true,
-						EntityCategory:   "diagnostic",
-						Icon:             "mdi:video",
-						Name:             "Video",
-						ObjectID:         fmt.Sprintf("%s_%s", topic, "video"),
-						Optimistic:       false,
-						Options:          []string{},
-						Platform:         "binary_sensor",
-						StateTopic:       fmt.Sprintf("%s/%s", prefix, topic),
-						UniqueID:         fmt.Sprintf("%s_%s_mutedeck2mqtt", topic, "video"),
-						ValueTemplate:    fmt.Sprintf("{{ value_json.%s != 'active' and 'OFF' or 'ON' }}", "video"),
-					},
-				},
-				StateTopic:       fmt.Sprintf("%s/%s", prefix, topic),
-				QualityOfService: 0,
-			}
-			jsonData, err := json.Marshal(discoveryPayload)
-			if err != nil {
-				logMessage(ERROR, fmt.Sprintf("Error marshaling discovery JSON data: %v", err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				mu.Unlock()
-				return
-			}
+	// Check for MUTEDECK_API, MUTEDECK_API_PATH and COMMAND_TOPIC
+	if list := os.Getenv("MUTEDECK_API"); list != "" {
+		apis, err := parseMuteDeckAPIs(list)
+		if err != nil {
+			log.Fatalf("Invalid MUTEDECK_API: %v", err)
+		}
+		muteDeckAPIs = apis
+	}
+	muteDeckAPIPath = envString("MUTEDECK_API_PATH", muteDeckAPIPath)
+	controlSwitches = envBool("CONTROL_SWITCHES", controlSwitches)
+	reannounceButton = envBool("REANNOUNCE_BUTTON", reannounceButton)
+	commandTopicRoot = strings.TrimSuffix(envString("COMMAND_TOPIC", commandTopicRoot), "/")
 
-			token := client.Publish(discoveryTopic, 0, false, jsonData) // Set retain flag to true for discovery
-			token.Wait()
-			if token.Error() != nil {
-				logMessage(ERROR, fmt.Sprintf("Error publishing discovery message to MQTT topic: %v", token.Error()))
-				http.Error(w, token.Error().Error(), http.StatusInternalServerError)
-				mu.Unlock()
-				return
+	// Check for COMMAND_CALLBACKS and CALLBACK_REGISTRATION
+	if list := os.Getenv("COMMAND_CALLBACKS"); list != "" {
+		callbacks, err := parseCommandCallbacks(list)
+		if err != nil {
+			log.Fatalf("Invalid COMMAND_CALLBACKS: %v", err)
+		}
+		commandCallbacks = callbacks
+	}
+	if callbackRegistration = envBool("CALLBACK_REGISTRATION", callbackRegistration); callbackRegistration {
+		for _, host := range strings.Split(os.Getenv("CALLBACK_HOSTS"), ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				callbackHosts[strings.ToLower(host)] = true
 			}
-			logMessage(INFO, fmt.Sprintf("Discovery message sent to topic: %s", discoveryTopic))
-			logMessage(DEBUG, fmt.Sprintf("Discovery message body: %s", jsonData))
+		}
+		if len(callbackHosts) == 0 {
+			log.Fatalf("CALLBACK_REGISTRATION requires CALLBACK_HOSTS")
+		}
+	}
+
+	// Check for COMMAND_POLLING, the devices that poll for their commands
+	if err := setCommandPolling(os.Getenv("COMMAND_POLLING")); err != nil {
+		log.Fatalf("Invalid COMMAND_POLLING: %v", err)
+	}
+
+	// Check for BRIDGE_COMMANDS and BRIDGE_COMMAND_TOPIC
+	bridgeCommands = envBool("BRIDGE_COMMANDS", bridgeCommands)
+	bridgeCommandTopic = envString("BRIDGE_COMMAND_TOPIC", bridgeCommandTopic)
 
-			discoveryTopics[discoveryTopic] = true
-			discoveryMessages[discoveryTopic] = discoveryPayload
+	// Check for ERROR_HISTORY_SIZE
+	recentErrorsSize = envInt("ERROR_HISTORY_SIZE", recentErrorsSize)
 
-			// Pause to give HA time to create the sensors
-			time.Sleep(2 * time.Second)
+	// Check for DND_SWITCH and DND_COMMAND
+	dndSwitch = envBool("DND_SWITCH", dndSwitch)
+	dndCommand = envString("DND_COMMAND", dndCommand)
+
+	// Check for OpenTelemetry tracing, configured with the standard
+	// OTEL_EXPORTER_OTLP_* variables
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"} {
+		if endpoint := os.Getenv(name); endpoint != "" {
+			if err := validateOutboundURL(endpoint); err != nil {
+				log.Fatalf("Invalid %s: %v", name, err)
+			}
+			tracing = true
 		}
-		mu.Unlock()
+	}
+	if tracing {
+		if err := setupTracing(context.Background()); err != nil {
+			log.Fatalf("Error setting up tracing: %v", err)
+		}
+	}
 
-		// Construct the full MQTT topic
-		fullTopic := fmt.Sprintf("%s/%s", prefix, topic)
+	// Check for INFLUXDB_URL and where states are written to
+	if influxURL = os.Getenv("INFLUXDB_URL"); influxURL != "" {
+		if err := validateOutboundURL(influxURL); err != nil {
+			log.Fatalf("Invalid INFLUXDB_URL: %v", err)
+		}
+		influxToken = os.Getenv("INFLUXDB_TOKEN")
+		influxOrg = os.Getenv("INFLUXDB_ORG")
+		influxBucket = os.Getenv("INFLUXDB_BUCKET")
+		if influxBucket == "" {
+			log.Fatalf("INFLUXDB_BUCKET is required with INFLUXDB_URL")
+		}
+		influxMeasurement = envString("INFLUXDB_MEASUREMENT", influxMeasurement)
+		go runInfluxWriter(influxDone)
+	}
 
-		// Publish the JSON data to the MQTT topic
-		jsonData, err := json.Marshal(data)
+	// Check for FORWARD_URLS and how states are forwarded to them
+	if list := os.Getenv("FORWARD_URLS"); list != "" {
+		urls, err := parseForwardURLs(list)
 		if err != nil {
-			logMessage(ERROR, fmt.Sprintf("Error marshaling JSON data: %v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			log.Fatalf("Invalid FORWARD_URLS: %v", err)
+		}
+		if text := os.Getenv("FORWARD_TEMPLATE"); text != "" {
+			tmpl, err := template.New("FORWARD_TEMPLATE").Funcs(templateFuncs).Parse(text)
+			if err != nil {
+				log.Fatalf("Invalid FORWARD_TEMPLATE: %v", err)
+			}
+			forwardTemplate = tmpl
+		}
+		forwardContentType = envString("FORWARD_CONTENT_TYPE", forwardContentType)
+		if forwardRetries = envInt("FORWARD_RETRIES", forwardRetries); forwardRetries < 0 {
+			log.Fatalf("Invalid FORWARD_RETRIES: %d", forwardRetries)
 		}
+		forwardURLs = urls
+		forwardQueue = newDeviceQueue(64, 4, true)
+	}
 
-		logMessage(DEBUG, fmt.Sprintf("Sending body: %s", jsonData))
-		token := client.Publish(fullTopic, 0, false, jsonData)
-		token.Wait()
-		if token.Error() != nil {
-			logMessage(ERROR, fmt.Sprintf("Error publishing to MQTT topic: %v", token.Error()))
-			http.Error(w, token.Error().Error(), http.StatusInternalServerError)
-			return
+	// Check for SLACK_TOKENS and the status set during calls
+	if list := os.Getenv("SLACK_TOKENS"); list != "" {
+		tokens, err := parseSlackTokens(list)
+		if err != nil {
+			log.Fatalf("Invalid SLACK_TOKENS: %v", err)
+		}
+		slackStatusText = envString("SLACK_STATUS_TEXT", slackStatusText)
+		slackStatusEmoji = envString("SLACK_STATUS_EMOJI", slackStatusEmoji)
+		slackDND = envBool("SLACK_DND", slackDND)
+		if slackDNDMinutes = envInt("SLACK_DND_MINUTES", slackDNDMinutes); slackDNDMinutes <= 0 {
+			log.Fatalf("Invalid SLACK_DND_MINUTES: %d", slackDNDMinutes)
 		}
+		slackTokens = tokens
+		slackQueue = newDeviceQueue(16, 2, true)
+	}
 
-		// Log the published message
-		logMessage(INFO, fmt.Sprintf("MQT: %s = %s", fullTopic, string(jsonData)))
+	// Check for BUSY_LIGHTS and the colors they show
+	if list := os.Getenv("BUSY_LIGHTS"); list != "" {
+		lights, err := parseBusyLights(list)
+		if err != nil {
+			log.Fatalf("Invalid BUSY_LIGHTS: %v", err)
+		}
+		for _, topicLights := range lights {
+			for _, light := range topicLights {
+				if light.kind == "esphome" && homeAssistantURL != "" {
+					log.Fatalf("Invalid BUSY_LIGHTS: ESPHome lights need MQTT, which isn't used with HOME_ASSISTANT_URL")
+				}
+			}
+		}
+		for _, c := range []struct {
+			name  string
+			color *[]byte
+		}{
+			{"BUSY_LIGHT_FREE_COLOR", &busyLightFree},
+			{"BUSY_LIGHT_CALL_COLOR", &busyLightCall},
+			{"BUSY_LIGHT_MUTED_COLOR", &busyLightMuted},
+		} {
+			if value := os.Getenv(c.name); value != "" {
+				if *c.color, err = parseBusyLightColor(value); err != nil {
+					log.Fatalf("Invalid %s: %v", c.name, err)
+				}
+			}
+		}
+		if busyLightBrightness = envInt("BUSY_LIGHT_BRIGHTNESS", busyLightBrightness); busyLightBrightness < 1 || busyLightBrightness > 255 {
+			log.Fatalf("Invalid BUSY_LIGHT_BRIGHTNESS: expected 1 to 255, got %d", busyLightBrightness)
+		}
+		busyLights = lights
+		busyLightQueue = newDeviceQueue(16, 2, false)
+	}
 
-		w.WriteHeader(http.StatusOK)
-	})
+	// Check for NOTIFY_RULE_<NAME>_<SETTING> notification rules
+	if err := loadNotifyRules(); err != nil {
+		log.Fatalf("Invalid notification rule: %v", err)
+	}
 
-	// Get the port from environment variable or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Check for STATSD_ADDRESS and how metrics are sent to it
+	if address := os.Getenv("STATSD_ADDRESS"); address != "" {
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			log.Fatalf("Invalid STATSD_ADDRESS: %v", err)
+		}
+		tags, err := parseStatsdTags(os.Getenv("STATSD_TAGS"))
+		if err != nil {
+			log.Fatalf("Invalid STATSD_TAGS: %v", err)
+		}
+		statsdAddress = address
+		statsdTags = tags
+		statsdPrefix = envString("STATSD_PREFIX", statsdPrefix)
+		if statsdPrefix != "" && !strings.HasSuffix(statsdPrefix, ".") {
+			statsdPrefix += "."
+		}
+		dogStatsD = envBool("STATSD_DOGSTATSD", dogStatsD)
+		go runStatsdSender(conn, statsdDone)
 	}
 
-	// Start the HTTP server
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
-}
+	// Check for SIMULATE and SIMULATE_TOPIC
+	simulate = envBool("SIMULATE", simulate)
+	simulateTopic = strings.TrimSuffix(envString("SIMULATE_TOPIC", simulateTopic), "/")
 
-func resendDiscoveryMessages(client mqtt.Client) {
-	mu.Lock()
-	defer mu.Unlock()
-	for topic, payload := range discoveryMessages {
-		jsonData, err := json.Marshal(payload)
-		if err != nil {
-			logMessage(ERROR, fmt.Sprintf("Error marshaling discovery JSON data: %v", err))
-			continue
+	// Check for HOME_ASSISTANT_STATUS_TOPIC and HOME_ASSISTANT_ONLINE_PAYLOAD
+	if topics := os.Getenv("HOME_ASSISTANT_STATUS_TOPIC"); topics != "" {
+		for _, topic := range strings.Split(topics, ",") {
+			if topic = strings.TrimSpace(topic); topic != "" {
+				homeAssistantStatusTopics = append(homeAssistantStatusTopics, topic)
+			}
 		}
+	} else {
+		homeAssistantStatusTopics = append(homeAssistantStatusTopics, fmt.Sprintf("%s/status", discovery_prefix))
+		for prefix := range allowedDiscoveryPrefixes {
+			homeAssistantStatusTopics = append(homeAssistantStatusTopics, fmt.Sprintf("%s/status", prefix))
+		}
+	}
+	homeAssistantOnlinePayload = envString("HOME_ASSISTANT_ONLINE_PAYLOAD", homeAssistantOnlinePayload)
 
-		token := client.Publish(topic, 0, false, jsonData)
-		token.Wait()
-		if token.Error() != nil {
-			logMessage(ERROR, fmt.Sprintf("Error publishing discovery message to MQTT topic: %v", token.Error()))
-			continue
+	// Check whether requests must name their content type
+	requireContentType = envBool("REQUIRE_CONTENT_TYPE", requireContentType)
+
+	// Check for STATE_TEMPLATE and STATE_TEMPLATE_<TOPIC>
+	if err := loadStateTemplates(); err != nil {
+		log.Fatalf("Invalid state template: %v", err)
+	}
+
+	// Check how topics are derived when a request doesn't name one
+	topicHeader = envString("TOPIC_HEADER", topicHeader)
+	topicFromReverseDNS = envBool("TOPIC_FROM_REVERSE_DNS", topicFromReverseDNS)
+
+	// Check for STATE_METADATA
+	stateMetadata = envBool("STATE_METADATA", stateMetadata)
+
+	// Check whether unchanged states are skipped
+	deduplicateStates = envBool("DEDUPLICATE_STATES", false)
+	deduplicateRefresh = envDuration("DEDUPLICATE_REFRESH", 5*time.Minute)
+
+	// Set client identifier
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = "mutedeck2mqtt"
+	}
+
+	// Settings that only work with MQTT can't be used with HOME_ASSISTANT_URL
+	if homeAssistantURL != "" {
+		var mqttOnly []string
+		for _, setting := range []struct {
+			name string
+			on   bool
+		}{
+			{"STATE_EXPIRY", stateExpiry > 0},
+			{"LAST_SEEN", lastSeen},
+			{"DEVICE_AVAILABILITY", deviceAvailability},
+			{"MEETING_TRACKING", meetingTracking},
+			{"BRIDGE_COMMANDS", bridgeCommands},
+		} {
+			if setting.on && os.Getenv(setting.name) != "" {
+				mqttOnly = append(mqttOnly, setting.name)
+			}
+		}
+		if len(mqttOnly) > 0 {
+			log.Fatalf("%s need MQTT, which isn't used with HOME_ASSISTANT_URL", strings.Join(mqttOnly, ", "))
+		}
+	}
+
+	// Create the primary MQTT client. The broker may not be up yet when both
+	// start together, so the connection is retried in the background while
+	// the bridge reports as not ready. Every broker is added before any of
+	// them connects, since brokers is read without a lock.
+	if mqttConnectMaxBackoff = envDuration("MQTT_CONNECT_MAX_BACKOFF", mqttConnectMaxBackoff); mqttConnectMaxBackoff <= 0 {
+		log.Fatalf("Invalid MQTT_CONNECT_MAX_BACKOFF: %s", mqttConnectMaxBackoff)
+	}
+	primaryConnected := make(chan struct{})
+	if homeAssistantURL == "" {
+		brokers = append(brokers, newBroker("primary", MQTT_HOST, MQTT_PORT, clientID, credentials, false))
+	} else {
+		// Without a broker, keep checking that Home Assistant accepts the
+		// token
+		go watchHomeAssistant()
+	}
+
+	// Check for an optional mirror broker
+	if mirrorHost := os.Getenv("MQTT_MIRROR_HOST"); mirrorHost != "" && homeAssistantURL == "" {
+		logMessage(INFO, "Using MQTT mirror server", "host", mirrorHost)
+
+		mirrorPort := 1883
+		if portStr := os.Getenv("MQTT_MIRROR_PORT"); portStr != "" {
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				log.Fatalf("Invalid MQTT_MIRROR_PORT: %v", err)
+			}
+			mirrorPort = port
+		}
+
+		mirrorClientID := os.Getenv("MQTT_MIRROR_CLIENT_ID")
+		if mirrorClientID == "" {
+			mirrorClientID = clientID
+		}
+
+		brokers = append(brokers, newBroker("mirror", mirrorHost, mirrorPort, mirrorClientID, credentialsFromEnv("MQTT_MIRROR"), true))
+	}
+
+	// Start connecting now that the brokers are complete
+	for _, b := range brokers {
+		if b.name == "primary" {
+			go connectWithRetry(b, primaryConnected)
+			continue
+		}
+		// Don't let an unreachable mirror stop the bridge, keep retrying in
+		// the background
+		b.client.Connect()
+	}
+
+	// Check for TOPIC_RENAMES and move the renamed devices once connected.
+	// Moving devices needs MQTT, without a broker it would wait forever.
+	if list := os.Getenv("TOPIC_RENAMES"); list != "" && homeAssistantURL != "" {
+		logMessage(WARN, "Ignoring TOPIC_RENAMES, renaming devices needs MQTT")
+	} else if list != "" {
+		renames, err := parseTopicRenames(list)
+		if err != nil {
+			log.Fatalf("Invalid TOPIC_RENAMES: %v", err)
+		}
+		go func() {
+			defer recoverGoroutine("topic migration")
+			<-primaryConnected
+			for from, to := range renames {
+				if err := migrateDevice(discovery_prefix, from, to); err != nil {
+					logMessage(ERROR, "Error renaming device", "topic", from, "new_topic", to, "error", err)
+					continue
+				}
+				logMessage(INFO, "Renamed device", "topic", from, "new_topic", to)
+			}
+		}()
+	}
+
+	// Periodically publish bridge diagnostics, announcing the bridge device
+	// unless BRIDGE_DISCOVERY is off. They're published over MQTT only.
+	bridgeDiscovery = envBool("BRIDGE_DISCOVERY", bridgeDiscovery)
+	bridgeStateTopic = envString("BRIDGE_STATE_TOPIC", bridgeStateTopic)
+	bridgeStateInterval := envDuration("BRIDGE_STATE_INTERVAL", time.Minute)
+	if bridgeStateInterval > 0 && homeAssistantURL == "" {
+		go func() {
+			<-primaryConnected
+			runDiagnostics(bridgeStateTopic, bridgeStateInterval)
+		}()
+	}
+
+	// Check for WATCHDOG_INTERVAL
+	if watchdogInterval = envDuration("WATCHDOG_INTERVAL", watchdogInterval); watchdogInterval > 0 {
+		go runWatchdog(watchdogInterval)
+	}
+
+	// Check for DISCOVERY_REANNOUNCE_INTERVAL
+	if interval := envDuration("DISCOVERY_REANNOUNCE_INTERVAL", 0); interval > 0 {
+		go runDiscoveryReannounce(interval)
+	}
+
+	// HTTP server handler
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r, DEBUG, "Request received")
+
+		// Reject paths that don't name a topic properly rather than
+		// publishing to a derived one
+		if _, _, err := webhookPath(r.URL.Path); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errTooManyPathLevels) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// Read the body
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Print the incoming body
+		logRequest(r, DEBUG, "Incoming body", "payload", string(body))
+
+		// Convert form and key=value bodies to JSON
+		body, err = bodyToJSON(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			logRequest(r, ERROR, "Request has an unreadable body", "error", err)
+			status := http.StatusBadRequest
+			if errors.Is(err, errUnsupportedMediaType) {
+				status = http.StatusUnsupportedMediaType
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// A batch is a JSON array of states, each naming its own topic
+		items := []json.RawMessage{body}
+		batch := bytes.HasPrefix(bytes.TrimSpace(body), []byte("["))
+		if batch {
+			if err := json.Unmarshal(body, &items); err != nil {
+				logRequest(r, ERROR, "Request has an invalid batch", "error", err)
+				http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+				return
+			}
+			if len(items) == 0 {
+				http.Error(w, "empty batch", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Parse and validate every state before publishing any of them
+		var updates []stateUpdate
+		var problems []string
+		for i, item := range items {
+			_, validateSpan := startSpan(r.Context(), "validate payload", spanKindInternal)
+			update, itemProblems := newStateUpdate(r, item, batch)
+			recordReceived(r, update, itemProblems)
+			validateSpan.setAttr("topic", update.fullTopic)
+			if len(itemProblems) > 0 {
+				validateSpan.finish(errors.New(strings.Join(itemProblems, "; ")))
+			} else {
+				validateSpan.finish(nil)
+			}
+			for _, problem := range itemProblems {
+				if batch {
+					problem = fmt.Sprintf("item %d: %s", i, problem)
+				}
+				problems = append(problems, problem)
+			}
+			updates = append(updates, update)
+		}
+		if len(problems) > 0 {
+			logRequest(r, ERROR, "Request has an invalid body", "problems", strings.Join(problems, "; "))
+			http.Error(w, strings.Join(problems, "\n"), http.StatusBadRequest)
+			return
+		}
+
+		// Publish the states, answering with the first failure if any, and
+		// with 202 Accepted if any state is still waiting to be published
+		status := http.StatusOK
+		var failure error
+		for _, update := range updates {
+			updateStatus, err := dispatchUpdate(r, update)
+			if err != nil {
+				if failure == nil {
+					status, failure = updateStatus, err
+				}
+				continue
+			}
+			if failure == nil && status != http.StatusAccepted {
+				status = updateStatus
+			}
+		}
+		if failure != nil {
+			if status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1")
+			}
+			http.Error(w, failure.Error(), status)
+			return
+		}
+
+		w.WriteHeader(status)
+	})
+
+	// Limit the number of webhooks handled at once
+	maxConcurrent := envInt("MAX_CONCURRENT_REQUESTS", 64)
+	if maxConcurrent <= 0 {
+		log.Fatalf("Invalid MAX_CONCURRENT_REQUESTS: %d", maxConcurrent)
+	}
+	handler = limitConcurrency(maxConcurrent, handler)
+
+	// Limit the request body size, before and after decompression
+	maxBodySize := envInt("MAX_BODY_SIZE", 8192)
+	if maxBodySize <= 0 {
+		log.Fatalf("Invalid MAX_BODY_SIZE: %d", maxBodySize)
+	}
+	handler = decompressBody(int64(maxBodySize), handler)
+
+	// Require a signature of the body as sent, before it's decompressed, if a
+	// secret is configured
+	if hmacSecret := os.Getenv("HMAC_SECRET"); hmacSecret != "" {
+		hmacHeader := envString("HMAC_HEADER", "X-Signature")
+		handler = requireSignature(hmacSecret, hmacHeader, handler)
+	}
+	handler = limitBody(int64(maxBodySize), handler)
+
+	// Require a token if one is configured, and only allow clients from the
+	// allowed networks if any are configured
+	var allowedNets []*net.IPNet
+	if cidrs := os.Getenv("ALLOWED_CIDRS"); cidrs != "" {
+		nets, err := parseCIDRs(cidrs)
+		if err != nil {
+			log.Fatalf("Invalid ALLOWED_CIDRS: %v", err)
+		}
+		allowedNets = nets
+	}
+	webhookAccess := func(h http.Handler) http.Handler {
+		if authToken := os.Getenv("AUTH_TOKEN"); authToken != "" {
+			h = requireToken(authToken, h)
+		}
+		if allowedNets != nil {
+			h = allowCIDRs(allowedNets, h)
+		}
+		return h
+	}
+	handler = webhookAccess(handler)
+
+	// Only accept webhooks as POST, GET / shows an informational page
+	handler = requirePost(handler)
+	handler = traceRequest(handler)
+	handler = measureRequest(handler)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handleInfo(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	http.Handle("/webhook/", handler)
+
+	// Devices the bridge can't reach poll for their commands, with the
+	// webhook's token and from its allowed networks. Polls have no body to
+	// sign, so HMAC_SECRET doesn't apply.
+	http.Handle("/commands/", webhookAccess(http.HandlerFunc(handleCommandPoll)))
+
+	// Recent errors, with the admin token if set
+	var errorsHandler http.Handler = http.HandlerFunc(handleErrors)
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		errorsHandler = requireToken(adminToken, errorsHandler)
+	}
+	http.Handle("/errors", errorsHandler)
+
+	// Live states for dashboards, with their own token if set and like the
+	// other endpoints exposing the devices' data otherwise
+	if websocketEnabled = envBool("WEBSOCKET", websocketEnabled); websocketEnabled {
+		for _, origin := range strings.Split(os.Getenv("WEBSOCKET_ORIGINS"), ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				websocketOrigins[origin] = true
+			}
+		}
+		var websocketHandler http.Handler = http.HandlerFunc(handleWebsocket)
+		if token := os.Getenv("WEBSOCKET_TOKEN"); token != "" {
+			websocketHandler = requireToken(token, websocketHandler)
+			websocketTokenRequired = true
+		} else {
+			websocketHandler = requireAdmin(os.Getenv("ADMIN_TOKEN"), allowedNets, websocketHandler)
+			websocketTokenRequired = os.Getenv("ADMIN_TOKEN") != ""
+		}
+		http.Handle("/ws", websocketHandler)
+	}
+	if eventsEnabled = envBool("EVENTS", eventsEnabled); eventsEnabled {
+		var eventsHandler http.Handler = http.HandlerFunc(handleEvents)
+		if token := os.Getenv("EVENTS_TOKEN"); token != "" {
+			eventsHandler = requireToken(token, eventsHandler)
+		} else {
+			eventsHandler = requireAdmin(os.Getenv("ADMIN_TOKEN"), allowedNets, eventsHandler)
+		}
+		http.Handle("/events", eventsHandler)
+	}
+
+	// Statistics of every topic, with the admin token or from the allowed
+	// networks
+	http.Handle("/stats", requireAdmin(os.Getenv("ADMIN_TOKEN"), allowedNets, http.HandlerFunc(handleStats)))
+
+	// Devices in the discovery cache, with the admin token or from the
+	// allowed networks
+	http.Handle("/devices", requireAdmin(os.Getenv("ADMIN_TOKEN"), allowedNets, http.HandlerFunc(handleDevices)))
+
+	// Last state of every device, with the admin token or from the allowed
+	// networks
+	stateHandler := requireAdmin(os.Getenv("ADMIN_TOKEN"), allowedNets, http.HandlerFunc(handleState))
+	http.Handle("/state", stateHandler)
+	http.Handle("/state/", stateHandler)
+
+	// Admin endpoints, only available with a token
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		http.Handle("/devices/", requireToken(adminToken, http.HandlerFunc(handleDevice)))
+		http.Handle("/admin/loglevel", requireToken(adminToken, http.HandlerFunc(handleLogLevel)))
+		http.Handle("/admin/discovery-cache", requireToken(adminToken, http.HandlerFunc(handleDiscoveryCache)))
+	}
+
+	// Health endpoints for container orchestration
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+
+	// Get the port from environment variable or use default
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	// Check for TLS configuration
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Log every request unless disabled, including the ones that panicked
+	var rootHandler http.Handler = recoverPanic(http.DefaultServeMux)
+	if tlsConfig != nil && tlsConfig.ClientCAs != nil {
+		rootHandler = requireClientCert(rootHandler)
+	}
+	if envBool("ACCESS_LOG", true) {
+		rootHandler = accessLog(rootHandler)
+	}
+	rootHandler = requestID(rootHandler)
+
+	// Check for a specific address to bind to. An address without a port
+	// uses PORT.
+	listenAddr := fmt.Sprintf(":%s", port)
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err == nil {
+			listenAddr = addr
+		} else {
+			listenAddr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+		}
+	}
+
+	// Check for a Unix socket to listen on instead of the TCP port
+	socketPath := os.Getenv("LISTEN_SOCKET")
+	socketMode, err := strconv.ParseUint(envString("LISTEN_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid LISTEN_SOCKET_MODE: %v", err)
+	}
+	listener, err := listen(socketPath, listenAddr, os.FileMode(socketMode))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Start the HTTP server
+	server := &http.Server{
+		Handler:      rootHandler,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  envDuration("HTTP_READ_TIMEOUT", 10*time.Second),
+		WriteTimeout: envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:  envDuration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+	}
+	server.RegisterOnShutdown(func() { close(eventsStop) })
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a signal to shut down
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	logMessage(INFO, "Received signal, shutting down", "signal", sig.String())
+	go func() {
+		// A second signal skips the rest of the shutdown
+		sig := <-stop
+		logMessage(WARN, "Received signal again, exiting", "signal", sig.String())
+		os.Exit(1)
+	}()
+
+	// Let in-flight requests finish before disconnecting from MQTT
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 10*time.Second))
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logMessage(WARN, "Error shutting down HTTP server", "error", err)
+	}
+
+	// Publish the states still waiting so they aren't lost, then announce
+	// the bridge as offline
+	if stateDebouncer != nil {
+		stateDebouncer.flush()
+	}
+	if publishQueue != nil && !publishQueue.wait(ctx) {
+		logMessage(WARN, "Shutdown timed out with states still queued")
+	}
+	if !waitContext(ctx, &delayedStates) {
+		logMessage(WARN, "Shutdown timed out with states still waiting for discovery")
+	}
+	if forwardQueue != nil && !forwardQueue.wait(ctx) {
+		logMessage(WARN, "Shutdown timed out with states still being forwarded")
+	}
+	if slackQueue != nil && !slackQueue.wait(ctx) {
+		logMessage(WARN, "Shutdown timed out with Slack statuses still being updated")
+	}
+	if busyLightQueue != nil {
+		turnOffAllBusyLights()
+	}
+	clearFlatTopics()
+	if busyLightQueue != nil && !busyLightQueue.wait(ctx) {
+		logMessage(WARN, "Shutdown timed out with busy lights still being updated")
+	}
+	flushNotifyRules()
+	if notifyQueue != nil && !notifyQueue.wait(ctx) {
+		logMessage(WARN, "Shutdown timed out with notifications still being sent")
+	}
+	disconnectBrokers()
+	// Export the spans still queued
+	shutdownTracing(ctx)
+	if influxURL != "" {
+		// Write the points still queued
+		close(influxStop)
+		<-influxDone
+	}
+	if statsdAddress != "" {
+		// Send the metrics still queued
+		close(statsdStop)
+		<-statsdDone
+	}
+	logMessage(INFO, "Shutdown complete")
+}
+
+// A validated state update for one device
+type stateUpdate struct {
+	prefix         string
+	topic          string
+	fullTopic      string
+	discoveryTopic string
+	device         Device
+	state          MuteDeckState
+	// Callback URL the device registered for its commands
+	callback string
+}
+
+// Parse a state from a JSON body and work out where it's published. batch
+// tells whether it's one of several states in a request.
+func newStateUpdate(r *http.Request, body []byte, batch bool) (stateUpdate, []string) {
+	state, problems := parseState(body)
+	if len(problems) > 0 {
+		return stateUpdate{}, problems
+	}
+
+	// Process the control field through getPlatformName
+	if state.Control != unknownValue {
+		state.Control = getPlatformName(state.Control)
+	}
+
+	// Get MQTT topic and prefix from the payload, URL path or parameters
+	prefix, topic := getTopic(r, state, batch)
+	topic = renamedTopic(topic)
+	discoveryPrefix := getDiscoveryPrefix(r, state)
+	callback := r.URL.Query().Get("callback")
+	if value, ok := state.Extra["callback"].(string); ok && value != "" {
+		callback = value
+	}
+	delete(state.Extra, "topic")
+	delete(state.Extra, "prefix")
+	delete(state.Extra, "discovery_prefix")
+	delete(state.Extra, "callback")
+
+	// Refuse values that would publish outside the device's own topics
+	for _, err := range []error{validateTopicLevel("prefix", prefix), validateTopicLevel("topic", topic)} {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return stateUpdate{}, problems
+	}
+	if !prefixAllowed(prefix) {
+		return stateUpdate{}, []string{fmt.Sprintf("prefix %q is not allowed", prefix)}
+	}
+	if !discoveryPrefixAllowed(discoveryPrefix) {
+		return stateUpdate{}, []string{fmt.Sprintf("discovery prefix %q is not allowed", discoveryPrefix)}
+	}
+	if callback != "" {
+		if !callbackRegistration {
+			return stateUpdate{}, []string{"callback registration is disabled"}
+		}
+		if err := validateRegisteredCallback(callback); err != nil {
+			return stateUpdate{}, []string{err.Error()}
+		}
+	}
+
+	// Leave out the entities disabled for this topic
+	if disabled := disabledEntities(topic); len(disabled) > 0 {
+		state.Omit = disabled
+	}
+
+	// Construct the full MQTT topic
+	fullTopic, err := buildStateTopic(stateTopicTemplate, r, prefix, topic)
+	if err != nil {
+		return stateUpdate{}, []string{fmt.Sprintf("could not build state topic: %v", err)}
+	}
+	if reserved := reservedTopicOverlap(fullTopic); reserved != "" {
+		return stateUpdate{}, []string{fmt.Sprintf("state topic %s overlaps the bridge's own topic %s", fullTopic, reserved)}
+	}
+
+	// The MuteDeck version in the payload is the most current one
+	device := deviceMetadata(r, topic)
+	if version := payloadVersion(state); version != "" {
+		device.SoftwareVersion = version
+	}
+
+	return stateUpdate{
+		prefix:         prefix,
+		topic:          topic,
+		fullTopic:      fullTopic,
+		discoveryTopic: deviceDiscoveryTopic(discoveryPrefix, topic),
+		device:         device,
+		state:          state,
+		callback:       callback,
+	}, nil
+}
+
+// Hand a state to the debouncer, the publish queue or publish it right away.
+// Returns the status to answer the webhook with.
+func dispatchUpdate(r *http.Request, update stateUpdate) (int, error) {
+	// Fail right away while the broker is unreachable or publishing is
+	// paused, unless states are queued until the broker is back
+	if offlineQueueFile == "" && homeAssistantURL == "" {
+		if len(brokers) == 0 || !brokers[0].isConnected() {
+			logRequest(r, WARN, "Not connected to the MQTT broker, rejecting state", "topic", update.topic)
+			return http.StatusServiceUnavailable, errBrokerDisconnected
+		}
+		if publishCircuit.isOpen() {
+			return http.StatusServiceUnavailable, errCircuitOpen
+		}
+	}
+
+	// States published after the webhook was answered outlive its request
+	later := r.WithContext(context.WithoutCancel(r.Context()))
+
+	// Wait for the state to settle before publishing it
+	if stateDebouncer != nil {
+		logRequest(r, DEBUG, "Debouncing state", "topic", update.topic)
+		stateDebouncer.submit(update.discoveryTopic, func() {
+			if asyncPublish {
+				if !publishQueue.enqueue(update.discoveryTopic, func() { publishState(later, update) }) {
+					logRequest(r, WARN, "Publish queue is full, dropping state", "topic", update.topic)
+				}
+				return
+			}
+			publishState(later, update)
+		})
+		return http.StatusAccepted, nil
+	}
+
+	// Queue the publish and answer right away in async mode
+	if asyncPublish {
+		if !publishQueue.enqueue(update.discoveryTopic, func() { publishState(later, update) }) {
+			logRequest(r, WARN, "Publish queue is full", "topic", update.topic)
+			return http.StatusServiceUnavailable, errors.New("Publish queue is full")
+		}
+		return http.StatusAccepted, nil
+	}
+
+	// A publish retried in the background is answered like an async one
+	ctx, retrying := trackRetries(r.Context())
+	deferred, err := publishState(r.WithContext(ctx), update)
+	if err != nil {
+		if errors.Is(err, errCircuitOpen) {
+			return http.StatusServiceUnavailable, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	if deferred || retrying.Load() {
+		return http.StatusAccepted, nil
+	}
+	return http.StatusOK, nil
+}
+
+// How long to wait after announcing a device before publishing its state,
+// to give Home Assistant time to create the entities
+var discoveryDelay = 2 * time.Second
+
+// States waiting for discoveryDelay before they're published
+var delayedStates sync.WaitGroup
+
+// Send the discovery message for a device if needed and publish its state.
+// After a discovery message the state is published in the background once
+// discoveryDelay passed, so the request doesn't wait for it. Returns whether
+// the state was left to the background.
+func publishState(r *http.Request, u stateUpdate) (bool, error) {
+	if homeAssistantURL != "" {
+		return false, pushHomeAssistantState(r, u)
+	}
+
+	ctx, publishSpan := startSpan(r.Context(), "publish state", spanKindInternal, "topic", u.fullTopic)
+	r = r.WithContext(ctx)
+
+	// Serialize requests for the same device so its states are published in
+	// order, other devices aren't blocked
+	unlock := deviceLocks.lock(u.discoveryTopic)
+
+	discoveryPayload, announced, err := announceDevice(r, u)
+	if err == nil && announced && discoveryDelay > 0 {
+		// The device stays locked while waiting so its later states are
+		// still published after this one
+		delayedStates.Add(1)
+		r := r.WithContext(context.WithoutCancel(r.Context()))
+		go func() {
+			defer delayedStates.Done()
+			defer unlock()
+			defer recoverGoroutine("delayed state publish")
+			time.Sleep(discoveryDelay)
+			err := publishDeviceState(r, u, discoveryPayload)
+			publishSpan.finish(err)
+			recordPublished(u, err)
+		}()
+		return true, nil
+	}
+	if err == nil {
+		err = publishDeviceState(r, u, discoveryPayload)
+	}
+	unlock()
+	publishSpan.finish(err)
+	recordPublished(u, err)
+	return false, err
+}
+
+// Announce a device as online and send its discovery message if it's new or
+// its entities changed. Returns the discovery payload and whether it was
+// sent.
+func announceDevice(r *http.Request, u stateUpdate) (DiscoveryPayloadStruct, bool, error) {
+	// Announce the device as online so its entities are available right away
+	touchDevice(u.fullTopic, u.state.Omit)
+	if deviceAvailability {
+		if err := markDeviceOnline(r.Context(), u.fullTopic); err != nil {
+			logRequest(r, ERROR, "Error publishing device availability", "topic", u.topic, "error", err)
+			return DiscoveryPayloadStruct{}, false, err
+		}
+	}
+
+	rememberDeviceState(u.topic, u.state)
+	if u.callback != "" {
+		registerCallback(u.topic, u.callback)
+	}
+
+	// Offer platforms the control select doesn't know yet
+	learnControlOption(u.state.Control)
+
+	discoveryPayload := buildDiscoveryPayload(u)
+
+	mu.Lock()
+	sent := discoveryTopics[u.discoveryTopic]
+	cached, known := discoveryMessages[u.discoveryTopic]
+	if known {
+		discoveryLastSeen[u.discoveryTopic] = time.Now()
+	}
+	mu.Unlock()
+
+	// Keep entities announced earlier even if this payload doesn't have their field
+	for id, component := range cached.Components {
+		if _, ok := discoveryPayload.Components[id]; !ok {
+			discoveryPayload.Components[id] = component
+		}
+	}
+
+	// Announce the device the first time and whenever its entities change
+	if !sent || !reflect.DeepEqual(cached, discoveryPayload) {
+		_, discoverySpan := startSpan(r.Context(), "discovery", spanKindInternal, "topic", u.discoveryTopic)
+		logRequest(r, DEBUG, "Preparing discovery topic")
+		if err := clearOtherDiscoveryFormat(r.Context(), u.discoveryTopic, discoveryPayload); err != nil {
+			logRequest(r, ERROR, "Error clearing discovery messages of the other format", "topic", u.discoveryTopic, "error", err)
+			discoverySpan.finish(err)
+			return discoveryPayload, false, err
+		}
+		messages, err := discoveryMessagesFor(u.discoveryTopic, discoveryPayload)
+		if err != nil {
+			logRequest(r, ERROR, "Error marshaling discovery JSON data", "topic", u.discoveryTopic, "error", err)
+			discoverySpan.finish(err)
+			return discoveryPayload, false, err
+		}
+
+		for topic, jsonData := range messages {
+			err = publishDiscovery(r.Context(), topic, jsonData)
+			if err != nil {
+				logRequest(r, ERROR, "Error publishing discovery message to MQTT topic", "topic", topic, "error", err)
+				discoverySpan.finish(err)
+				return discoveryPayload, false, err
+			}
+			logRequest(r, INFO, "Discovery message sent", "topic", topic)
+			logRequest(r, DEBUG, "Discovery message body", "topic", topic, "payload", string(jsonData))
+		}
+
+		mu.Lock()
+		cacheDiscovery(u.discoveryTopic, discoveryPayload)
+		mu.Unlock()
+		saveDiscoveryCache()
+		discoverySpan.finish(nil)
+		return discoveryPayload, true, nil
+	}
+	return discoveryPayload, false, nil
+}
+
+// Publish a device's state, with its last seen time, attributes and meeting
+// events
+func publishDeviceState(r *http.Request, u stateUpdate, discoveryPayload DiscoveryPayloadStruct) error {
+	// Every webhook counts as seen, even if its state is unchanged
+	if lastSeen && !u.state.Omit[lastSeenEntity.Key] {
+		if err := publishLastSeen(r.Context(), u.fullTopic); err != nil {
+			logRequest(r, ERROR, "Error publishing last seen time", "topic", u.fullTopic, "error", err)
+			return err
+		}
+	}
+
+	// Announced extra fields missing from this payload are unknown
+	for _, e := range extraEntities {
+		if _, ok := discoveryPayload.Components[fmt.Sprintf("%s_%s", deviceIDOf(u.topic), e.Key)]; !ok {
+			continue
+		}
+		if _, ok := u.state.Extra[e.Key]; !ok {
+			if u.state.Extra == nil {
+				u.state.Extra = make(map[string]interface{})
+			}
+			u.state.Extra[e.Key] = unknownValue
+		}
+	}
+
+	// Track when the meeting started
+	meetingEvent := trackMeeting(u.fullTopic, &u.state)
+
+	// Publish the JSON data to the MQTT topic
+	jsonData, err := json.Marshal(u.state)
+	if err != nil {
+		logRequest(r, ERROR, "Error marshaling JSON data", "topic", u.topic, "error", err)
+		return err
+	}
+
+	// Skip states identical to the last one published
+	if deduplicateStates && !stateChanged(u.fullTopic, jsonData, deduplicateRefresh) {
+		logRequest(r, DEBUG, "State unchanged, not publishing", "topic", u.fullTopic, "payload", string(jsonData))
+		// The retained state is still current
+		if stateRetain && stateExpiry > 0 {
+			scheduleDeviceExpiry(u, stateExpiry)
+			if stateFormat != "fields" {
+				scheduleStateExpiry(u.fullTopic, stateExpiry)
+			}
+			if stateFormat != "json" {
+				for _, key := range fieldKeys(u.state.fields()) {
+					scheduleStateExpiry(fmt.Sprintf("%s/%s", u.fullTopic, key), stateExpiry)
+				}
+			}
+		}
+		return nil
+	}
+	// Later states are compared against the state without its metadata
+	stateData := jsonData
+
+	if stateMetadata {
+		u.state.LastUpdated = time.Now().UTC().Format(time.RFC3339)
+		u.state.Seq = atomic.AddUint64(&stateSeq, 1)
+	}
+	// The duration changes with every state, so it's left out of the comparison
+	if meetingTracking {
+		u.state.MeetingDuration = meetingDuration(u.state.MeetingStartedAt)
+	}
+	if stateMetadata || meetingTracking {
+		jsonData, err = json.Marshal(u.state)
+		if err != nil {
+			logRequest(r, ERROR, "Error marshaling JSON data", "topic", u.topic, "error", err)
+			return err
+		}
+	}
+
+	// Reshape the state for consumers expecting a different layout
+	transformed, err := transformState(u.topic, u.state)
+	if err != nil {
+		logRequest(r, ERROR, "Error applying state template", "topic", u.topic, "error", err)
+		return err
+	}
+	if transformed != nil {
+		jsonData = transformed
+	}
+
+	if stateFormat != "fields" {
+		logRequest(r, DEBUG, "Sending body", "topic", u.fullTopic, "payload", string(jsonData))
+		err = tracedPublish(r, u.fullTopic, 0, stateRetain, jsonData)
+		if err != nil {
+			logRequest(r, ERROR, "Error publishing to MQTT topic", "topic", u.fullTopic, "error", err)
+			return err
+		}
+		if stateRetain && stateExpiry > 0 {
+			scheduleStateExpiry(u.fullTopic, stateExpiry)
+		}
+	}
+
+	// Publish every field to its own topic
+	if stateFormat != "json" {
+		fields := u.state.fields()
+		for _, key := range fieldKeys(fields) {
+			fieldTopic := fmt.Sprintf("%s/%s", u.fullTopic, key)
+			if err := tracedPublish(r, fieldTopic, 0, stateRetain, fieldPayload(fields[key])); err != nil {
+				logRequest(r, ERROR, "Error publishing to MQTT topic", "topic", fieldTopic, "error", err)
+				return err
+			}
+			if stateRetain && stateExpiry > 0 {
+				scheduleStateExpiry(fieldTopic, stateExpiry)
+			}
+		}
+		logRequest(r, DEBUG, "Published fields", "topic", u.fullTopic+"/+")
+	}
+
+	if stateRetain && stateExpiry > 0 {
+		scheduleDeviceExpiry(u, stateExpiry)
+	}
+
+	// Publish whether the device is in a call as a plain retained boolean
+	// for consumers that don't use discovery
+	if flatTopicPrefix != "" && !u.state.Omit["call"] && u.state.Call != "" && u.state.Call != unknownValue {
+		busy := strconv.FormatBool(u.state.Call == "active")
+		flat := flatTopic(u.prefix, u.topic)
+		if err := tracedPublish(r, flat, 0, true, []byte(busy)); err != nil {
+			logRequest(r, ERROR, "Error publishing to MQTT topic", "topic", flat, "error", err)
+			return err
+		}
+		flatTopicsMu.Lock()
+		flatTopics[u.fullTopic] = flat
+		flatTopicsMu.Unlock()
+	}
+
+	// Publish the parsed state for the entities showing it as attributes.
+	// It's always JSON, whatever the state format or template.
+	if len(attributesEntities) > 0 {
+		attributes, err := json.Marshal(u.state)
+		if err != nil {
+			logRequest(r, ERROR, "Error marshaling JSON data", "topic", u.topic, "error", err)
+			return err
+		}
+		if err := tracedPublish(r, attributesTopic(u.fullTopic), 0, stateRetain, attributes); err != nil {
+			logRequest(r, ERROR, "Error publishing attributes to MQTT topic", "topic", attributesTopic(u.fullTopic), "error", err)
+			return err
+		}
+	}
+	statePublished(u, stateData)
+
+	// Announce meetings starting or ending
+	if meetingEvent != nil && !u.state.Omit["meeting"] {
+		if err := publishMeetingEvent(u.fullTopic, meetingEvent); err != nil {
+			logRequest(r, ERROR, "Error publishing meeting event", "topic", u.topic, "error", err)
+		}
+	}
+	updateMeeting(u.fullTopic, u.state.InMeeting == "active")
+
+	// Log the published message
+	logRequest(r, INFO, "MQT", "topic", u.fullTopic, "payload", string(jsonData))
+	return nil
+}
+
+// Flat busy topic of a device, <flat prefix>/<topic> under the default
+// prefix and <flat prefix>/<prefix>/<topic> under any other, so devices with
+// the same topic under different prefixes don't share it
+func flatTopic(prefix string, topic string) string {
+	if prefix == defaultPrefix {
+		return fmt.Sprintf("%s/%s", flatTopicPrefix, topic)
+	}
+	return fmt.Sprintf("%s/%s/%s", flatTopicPrefix, prefix, topic)
+}
+
+// Clear the flat topic published for a state topic. Without one published
+// since the bridge started, the flat topic of the device's topic under the
+// default prefix is cleared, unless topic is empty.
+func clearFlatTopic(fullTopic string, topic string) error {
+	if flatTopicPrefix == "" {
+		return nil
+	}
+	flatTopicsMu.Lock()
+	flat, ok := flatTopics[fullTopic]
+	delete(flatTopics, fullTopic)
+	flatTopicsMu.Unlock()
+	if !ok {
+		if topic == "" {
+			return nil
+		}
+		flat = flatTopic(defaultPrefix, topic)
+	}
+	return publish(flat, 0, true, []byte{})
+}
+
+// Clear every flat topic, when the bridge shuts down and can't tell whether
+// the devices are busy anymore
+func clearFlatTopics() {
+	flatTopicsMu.Lock()
+	fullTopics := make([]string, 0, len(flatTopics))
+	for fullTopic := range flatTopics {
+		fullTopics = append(fullTopics, fullTopic)
+	}
+	flatTopicsMu.Unlock()
+	for _, fullTopic := range fullTopics {
+		if err := clearFlatTopic(fullTopic, ""); err != nil {
+			logMessage(WARN, "Error clearing flat topic", "topic", fullTopic, "error", err)
+		}
+	}
+}
+
+// Remember a published state and hand it to the outputs following states
+func statePublished(u stateUpdate, stateData []byte) {
+	rememberState(u.fullTopic, u.topic, stateData)
+	recordInfluxState(u.topic, u.state)
+	forwardState(u)
+	syncSlackStatus(u.topic, u.state)
+	updateBusyLights(u.topic, u.state)
+	notifyState(u)
+	broadcastState(u)
+}
+
+// Clear a retained state once it hasn't been refreshed within the expiry
+// interval. The MQTT client only speaks MQTT 3.1.1, which has no message
+// expiry, so the bridge removes the retained message itself.
+func scheduleStateExpiry(topic string, expiry time.Duration) {
+	scheduleExpiry(expiryTimers, topic, expiry, func() {
+		if err := publish(topic, 0, true, []byte{}); err != nil {
+			logMessage(ERROR, "Error clearing expired state on MQTT topic", "topic", topic, "error", err)
+			return
+		}
+		logMessage(INFO, "Cleared expired retained state", "topic", topic)
+	})
+}
+
+// Turn a device's busy lights off and clear its flat topic once its state
+// expired
+func scheduleDeviceExpiry(u stateUpdate, expiry time.Duration) {
+	scheduleExpiry(deviceExpiryTimers, u.fullTopic, expiry, func() {
+		turnOffBusyLights(u.topic)
+		if err := clearFlatTopic(u.fullTopic, ""); err != nil {
+			logMessage(ERROR, "Error clearing expired flat topic", "topic", u.fullTopic, "error", err)
+		}
+	})
+}
+
+// Run expire once key's timer hasn't been reset within expiry
+func scheduleExpiry(timers map[string]*time.Timer, key string, expiry time.Duration, expire func()) {
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+
+	if timer, ok := timers[key]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(expiry, func() {
+		expiryMu.Lock()
+		if timers[key] != timer {
+			// A newer state replaced this timer
+			expiryMu.Unlock()
+			return
+		}
+		delete(timers, key)
+		expiryMu.Unlock()
+
+		expire()
+	})
+	timers[key] = timer
+}
+
+// Resend discovery messages when Home Assistant comes back online
+func onHomeAssistantStatus(client mqtt.Client, msg mqtt.Message) {
+	if string(msg.Payload()) == homeAssistantOnlinePayload {
+		logMessage(INFO, "Home Assistant is online, resending discovery message")
+		resendDiscoveryMessages(client)
+	}
+}
+
+func resendDiscoveryMessages(client mqtt.Client) {
+	// Copy the messages so requests aren't blocked while publishing
+	mu.Lock()
+	messages := make(map[string]DiscoveryPayloadStruct, len(discoveryMessages))
+	for topic, payload := range discoveryMessages {
+		messages[topic] = payload
+	}
+	mu.Unlock()
+	for topic, payload := range bridgeDiscoveryMessage() {
+		messages[topic] = payload
+	}
+
+	for discoveryTopic, payload := range messages {
+		// Devices loaded from DISCOVERY_CACHE_FILE may have been announced in
+		// the other format before a restart
+		if err := clearOtherDiscoveryFormat(context.Background(), discoveryTopic, payload); err != nil {
+			logMessage(ERROR, "Error clearing discovery messages of the other format", "topic", discoveryTopic, "error", err)
+		}
+		deviceMessages, err := discoveryMessagesFor(discoveryTopic, payload)
+		if err != nil {
+			logMessage(ERROR, "Error marshaling discovery JSON data", "topic", discoveryTopic, "error", err)
+			continue
+		}
+
+		for topic, jsonData := range deviceMessages {
+			token := client.Publish(topic, discoveryQoS, discoveryRetain, jsonData)
+			if !token.WaitTimeout(publishTimeout) {
+				logMessage(ERROR, "Error publishing discovery message to MQTT topic: not acknowledged", "topic", topic)
+				continue
+			}
+			if token.Error() != nil {
+				logMessage(ERROR, "Error publishing discovery message to MQTT topic", "topic", topic, "error", token.Error())
+				continue
+			}
+			logMessage(INFO, "Resent discovery message", "topic", topic)
+			logMessage(DEBUG, "Resent discovery message body", "topic", topic, "payload", string(jsonData))
+		}
+	}
+}
+
+// Resend the discovery messages of a device under every discovery prefix it
+// was announced under
+func reannounceDevice(topic string) error {
+	mu.Lock()
+	messages := make(map[string]DiscoveryPayloadStruct)
+	for discoveryTopic, payload := range discoveryMessages {
+		if discoveryTopic == deviceDiscoveryTopic(discoveryPrefixOf(discoveryTopic), topic) {
+			messages[discoveryTopic] = payload
+		}
+	}
+	mu.Unlock()
+	if len(messages) == 0 {
+		return fmt.Errorf("unknown device %s", topic)
+	}
+
+	for discoveryTopic, payload := range messages {
+		deviceMessages, err := discoveryMessagesFor(discoveryTopic, payload)
+		if err != nil {
+			return err
+		}
+		for configTopic, jsonData := range deviceMessages {
+			if err := publishDiscovery(context.Background(), configTopic, jsonData); err != nil {
+				return err
+			}
+			logMessage(INFO, "Resent discovery message", "topic", configTopic)
+		}
+	}
+	return nil
+}
+
+// Resend every discovery message to the connected brokers on a fixed
+// interval, in case Home Assistant or the broker lost them
+func runDiscoveryReannounce(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		logMessage(INFO, "Re-announcing discovery messages")
+		for _, b := range brokers {
+			if b.isConnected() {
+				resendDiscoveryMessages(b.client)
+			}
 		}
-		logMessage(INFO, fmt.Sprintf("Resent discovery message to topic: %s", topic))
-		logMessage(DEBUG, fmt.Sprintf("Resent discovery message body: %s", jsonData))
 	}
 }
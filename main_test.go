@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetClientIP(t *testing.T) {
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	var err error
+	if trustedProxies, err = parseCIDRs("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{name: "no proxy", remote: "192.168.1.20:51234", want: "192.168.1.20:51234"},
+		{name: "spoofed by an untrusted peer", remote: "192.168.1.20:51234", forwarded: "192.168.1.99", want: "192.168.1.20:51234"},
+		{name: "trusted proxy", remote: "10.0.0.1:51234", forwarded: "192.168.1.20", want: "192.168.1.20"},
+		{name: "chain of trusted proxies", remote: "10.0.0.1:51234", forwarded: "192.168.1.20, 10.0.0.3, 10.0.0.2", want: "192.168.1.20"},
+		{name: "spoofed hop left of the client", remote: "10.0.0.1:51234", forwarded: "192.168.1.99, 192.168.1.20, 10.0.0.2", want: "192.168.1.20"},
+		{name: "only trusted hops", remote: "10.0.0.1:51234", forwarded: "10.0.0.3, 10.0.0.2", want: "10.0.0.3"},
+		{name: "empty hops", remote: "10.0.0.1:51234", forwarded: "192.168.1.20, , 10.0.0.2,", want: "192.168.1.20"},
+		{name: "only commas", remote: "10.0.0.1:51234", forwarded: " , ,", want: "10.0.0.1:51234"},
+		{name: "hop that isn't an address", remote: "10.0.0.1:51234", forwarded: "192.168.1.20, not-an-ip", want: "not-an-ip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := getClientIP(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		topic  string
+		err    error
+	}{
+		{path: "/"},
+		{path: "/webhook"},
+		{path: "/webhook/"},
+		{path: "/webhook/laptop", topic: "laptop"},
+		{path: "/webhook/laptop/", topic: "laptop"},
+		{path: "/webhook/a/b", prefix: "a", topic: "b"},
+		{path: "/webhook/a/b/c", err: errTooManyPathLevels},
+		{path: "/webhook//", err: errEmptyPathLevel},
+		{path: "/webhook//laptop", err: errEmptyPathLevel},
+		{path: "/webhook/a//b", err: errEmptyPathLevel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			prefix, topic, err := webhookPath(tt.path)
+			if prefix != tt.prefix || topic != tt.topic || !errors.Is(err, tt.err) {
+				t.Errorf("got prefix %q, topic %q and error %v, want %q, %q and %v", prefix, topic, err, tt.prefix, tt.topic, tt.err)
+			}
+		})
+	}
+}
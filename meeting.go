@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Publish whether anyone is in a meeting across all devices
+var anyoneInMeeting = false
+
+// Topic the aggregate is published to
+var anyoneInMeetingTopic = "mutedeck2mqtt/bridge/in_meeting"
+
+// Devices currently in a meeting, by state topic, and the last aggregate
+// published
+var meetingDevices = make(map[string]bool)
+var meetingPublished = false
+var meetingAnnounced = false
+var lastAnyoneInMeeting = false
+var meetingMu sync.Mutex
+
+// Record whether a device is in a meeting and publish the aggregate when it
+// changes
+func updateMeeting(fullTopic string, inMeeting bool) {
+	if !anyoneInMeeting {
+		return
+	}
+
+	meetingMu.Lock()
+	defer meetingMu.Unlock()
+
+	if inMeeting {
+		meetingDevices[fullTopic] = true
+	} else {
+		delete(meetingDevices, fullTopic)
+	}
+	anyone := len(meetingDevices) > 0
+
+	if !meetingAnnounced {
+		if err := announceAnyoneInMeeting(); err != nil {
+			logMessage(ERROR, "Error publishing discovery message to MQTT topic", "error", err)
+			return
+		}
+		meetingAnnounced = true
+	}
+	if meetingPublished && anyone == lastAnyoneInMeeting {
+		return
+	}
+
+	payload := "OFF"
+	if anyone {
+		payload = "ON"
+	}
+	if err := publish(anyoneInMeetingTopic, 0, true, []byte(payload)); err != nil {
+		logMessage(ERROR, "Error publishing to MQTT topic", "topic", anyoneInMeetingTopic, "error", err)
+		return
+	}
+	meetingPublished = true
+	lastAnyoneInMeeting = anyone
+	logMessage(INFO, "MQT", "topic", anyoneInMeetingTopic, "payload", payload)
+}
+
+// Announce the aggregate entity on a device representing the bridge
+func announceAnyoneInMeeting() error {
+	payload := EntityDiscoveryPayload{
+		Component: Component{
+			EnabledByDefault: true,
+			Icon:             "mdi:account-group",
+			Name:             localizedName("anyone_in_meeting", "Anyone in a meeting"),
+			ObjectID:         "anyone_in_meeting",
+			Options:          []string{},
+			StateTopic:       anyoneInMeetingTopic,
+			UniqueID:         "anyone_in_meeting_mutedeck2mqtt",
+		},
+		Device: Device{
+			IDs:          []string{"mutedeck2mqtt_bridge"},
+			Name:         "MuteDeck2MQTT",
+			Manufacturer: "MuteDeck2MQTT",
+		},
+		Origin:       origin,
+		Availability: []Availability{{Topic: availabilityTopic}},
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("%s/binary_sensor/mutedeck2mqtt_bridge/anyone_in_meeting/config", discovery_prefix)
+	if err := publishDiscovery(context.Background(), topic, jsonData); err != nil {
+		return err
+	}
+	logMessage(INFO, "Discovery message sent", "topic", topic)
+	return nil
+}
+
+// Track meeting start times and durations per device
+var meetingTracking = false
+
+// When each device's current meeting started, by state topic
+var meetingStarts = make(map[string]time.Time)
+var meetingStartsMu sync.Mutex
+
+// A meeting starting or ending
+type MeetingEvent struct {
+	EventType string `json:"event_type"`
+	StartedAt string `json:"started_at"`
+	Duration  int64  `json:"duration,omitempty"`
+}
+
+// Record when a device's meeting started and set the state's start time.
+// Returns the event to announce if a meeting started or ended.
+func trackMeeting(fullTopic string, state *MuteDeckState) *MeetingEvent {
+	if !meetingTracking {
+		return nil
+	}
+
+	meetingStartsMu.Lock()
+	defer meetingStartsMu.Unlock()
+
+	start, inMeeting := meetingStarts[fullTopic]
+	var event *MeetingEvent
+	switch {
+	case state.InMeeting == "active" && !inMeeting:
+		start = time.Now().UTC()
+		meetingStarts[fullTopic] = start
+		inMeeting = true
+		event = &MeetingEvent{EventType: "meeting_started", StartedAt: start.Format(time.RFC3339)}
+	case state.InMeeting == "inactive" && inMeeting:
+		delete(meetingStarts, fullTopic)
+		inMeeting = false
+		event = &MeetingEvent{EventType: "meeting_ended", StartedAt: start.Format(time.RFC3339), Duration: int64(time.Since(start).Seconds())}
+	}
+
+	if inMeeting {
+		state.MeetingStartedAt = start.Format(time.RFC3339)
+	}
+	return event
+}
+
+// Seconds since a meeting started, zero if there is no meeting
+func meetingDuration(startedAt string) *int64 {
+	var duration int64
+	if start, err := time.Parse(time.RFC3339, startedAt); err == nil {
+		duration = int64(time.Since(start).Seconds())
+	}
+	return &duration
+}
+
+// Publish a meeting starting or ending to the device's event topic
+func publishMeetingEvent(fullTopic string, event *MeetingEvent) error {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	topic := fmt.Sprintf("%s/%s", fullTopic, findEntity("meeting").Topic)
+	if err := publish(topic, 0, false, jsonData); err != nil {
+		return err
+	}
+	logMessage(INFO, "MQT", "topic", topic, "payload", string(jsonData))
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Context key for the request ID
+type requestIDKey struct{}
+
+// Get the ID of a request, empty if it has none
+func getRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Log a message tagged with the request's ID and client address
+func logRequest(r *http.Request, level slog.Level, message string, args ...any) {
+	attrs := []any{"client_ip", getClientIP(r)}
+	if id := getRequestID(r); id != "" {
+		attrs = append([]any{"request_id", id}, attrs...)
+	}
+	if id := traceIDFrom(r.Context()); id != "" {
+		attrs = append(attrs, "trace_id", id)
+	}
+	logger.Log(r.Context(), level, message, append(attrs, args...)...)
+}
+
+// Check that an incoming request ID is safe to log and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Tag every request with an ID, honoring a valid incoming X-Request-ID
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Response writer that remembers the status code written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Let WebSocket connections take over the connection
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", r.ResponseWriter)
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Let the event stream flush and change its deadlines
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Log every request as key=value fields
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		logRequest(r, INFO, "Request", "method", r.Method, "path", r.URL.Path, "status", recorder.status,
+			"latency", time.Since(start).String(), "topic", r.URL.Query().Get("topic"))
+	})
+}
+
+// Answer a request that panicked with 500 and log the stack trace instead of
+// letting net/http drop the connection
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// Used to abort a response on purpose
+				panic(p)
+			}
+			logRequest(r, ERROR, "Panic handling request", "method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			recordRecentError("panic", r.URL.Query().Get("topic"), fmt.Sprint(p))
+			statsdCount("webhook.panics", 1)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Log a panic in a background goroutine instead of letting it crash the
+// bridge. Deferred first thing in the goroutines the bridge starts.
+func recoverGoroutine(name string) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	logMessage(ERROR, "Panic in goroutine", "goroutine", name, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+	recordRecentError("panic", "", fmt.Sprintf("%s: %v", name, p))
+	statsdCount("goroutine.panics", 1)
+}
+
+// Run a job, recovering from a panic in it so the worker running it
+// survives
+func runRecovered(name string, job func()) {
+	defer recoverGoroutine(name)
+	job()
+}
+
+// Only allow POST requests, anything else is rejected with 405
+func requirePost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Limit the number of requests handled at once, rejecting the rest with 503
+func limitConcurrency(limit int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			logRequest(r, WARN, "Rejected request, too many requests in progress", "limit", limit)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Decompress gzip and deflate request bodies, limiting the decompressed size
+// as well so a small compressed body can't expand into a huge one
+func decompressBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid gzip body: %v", err), http.StatusBadRequest)
+				return
+			}
+			defer reader.Close()
+			body = reader
+		case "deflate":
+			// HTTP deflate is zlib wrapped, but some senders use raw deflate
+			buffered := bufio.NewReader(r.Body)
+			if header, err := buffered.Peek(2); err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+				reader, err := zlib.NewReader(buffered)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid deflate body: %v", err), http.StatusBadRequest)
+					return
+				}
+				defer reader.Close()
+				body = reader
+			} else {
+				reader := flate.NewReader(buffered)
+				defer reader.Close()
+				body = reader
+			}
+		default:
+			logRequest(r, WARN, "Rejected request with unsupported Content-Encoding", "encoding", encoding)
+			http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, io.NopCloser(body), limit)
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+
+		next.ServeHTTP(w, r)
+	})
+}
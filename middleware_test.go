@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimitConcurrency(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := limitConcurrency(1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w
+	}
+
+	done := make(chan int)
+	go func() { done <- serve("/slow").Code }()
+	<-entered
+
+	w := serve("/webhook")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while the limit is reached, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header while the limit is reached")
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("got status %d for the request holding the slot, want %d", code, http.StatusOK)
+	}
+	if code := serve("/webhook").Code; code != http.StatusOK {
+		t.Errorf("got status %d once the slot is free, want %d", code, http.StatusOK)
+	}
+}
+
+// A handler answering with the request body, or the error reading it
+var readBody = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(body)
+})
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buf)
+	case "zlib":
+		writer = zlib.NewWriter(&buf)
+	case "flate":
+		var err error
+		if writer, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressBody(t *testing.T) {
+	const limit = 1024
+	state := []byte(`{"call":"active","control":"zoom","mute":"active","record":"active","share":"active","video":"active"}`)
+	gzipped := compress(t, "gzip", state)
+	// Compresses to a few bytes, but expands past the limit
+	bomb := compress(t, "gzip", bytes.Repeat([]byte(" "), 64*limit))
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		want     []byte
+	}{
+		{name: "not compressed", body: state, status: http.StatusOK, want: state},
+		{name: "identity", encoding: "identity", body: state, status: http.StatusOK, want: state},
+		{name: "gzip", encoding: "gzip", body: gzipped, status: http.StatusOK, want: state},
+		{name: "x-gzip", encoding: "x-gzip", body: gzipped, status: http.StatusOK, want: state},
+		{name: "zlib wrapped deflate", encoding: "deflate", body: compress(t, "zlib", state), status: http.StatusOK, want: state},
+		{name: "raw deflate", encoding: "deflate", body: compress(t, "flate", state), status: http.StatusOK, want: state},
+		{name: "not gzip", encoding: "gzip", body: state, status: http.StatusBadRequest},
+		{name: "gzip cut short", encoding: "gzip", body: gzipped[:len(gzipped)/2], status: http.StatusBadRequest},
+		{name: "corrupt deflate", encoding: "deflate", body: []byte{0xff, 0xff, 0xff, 0xff}, status: http.StatusBadRequest},
+		{name: "unsupported encoding", encoding: "br", body: state, status: http.StatusUnsupportedMediaType},
+		{name: "expands past the limit", encoding: "gzip", body: bomb, status: http.StatusRequestEntityTooLarge},
+	}
+	// Wrapped like the webhook handler, the compressed size is limited first
+	handler := limitBody(limit, decompressBody(limit, readBody))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.body) > limit {
+				t.Fatalf("compressed body of %d bytes is over the limit already", len(tt.body))
+			}
+			r := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.want != nil && !bytes.Equal(w.Body.Bytes(), tt.want) {
+				t.Errorf("next handler read %q, want %q", w.Body, tt.want)
+			}
+		})
+	}
+}
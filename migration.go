@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Renamed topics, by old topic. Webhooks for an old topic are published
+// under its new one.
+var topicRenames = make(map[string]string)
+var topicRenamesMu sync.Mutex
+
+// Parse a comma separated list of old=new topic renames
+func parseTopicRenames(list string) (map[string]string, error) {
+	renames := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected old=new, got %q", entry)
+		}
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		for _, err := range []error{validateTopicLevel("old topic", from), validateTopicLevel("new topic", to)} {
+			if err != nil {
+				return nil, err
+			}
+		}
+		if from == to {
+			return nil, fmt.Errorf("%s is renamed to itself", from)
+		}
+		renames[from] = to
+	}
+	return renames, nil
+}
+
+// Get the topic a device is published under after renames
+func renamedTopic(topic string) string {
+	topicRenamesMu.Lock()
+	defer topicRenamesMu.Unlock()
+	if to, ok := topicRenames[topic]; ok {
+		return to
+	}
+	return topic
+}
+
+// IDs of renamed devices, by their current topic. A device keeps the ID of
+// the topic it was first announced under, which its discovery topic, unique
+// IDs and device identifiers are built from, so Home Assistant keeps its
+// entities when it moves. Guarded by topicRenamesMu.
+var deviceIDs = make(map[string]string)
+
+// Get the ID of the device published under a topic
+func deviceIDOf(topic string) string {
+	topicRenamesMu.Lock()
+	defer topicRenamesMu.Unlock()
+	if id, ok := deviceIDs[topic]; ok {
+		return id
+	}
+	return topic
+}
+
+// Get the topic the device with an ID is published under
+func topicOfDevice(id string) string {
+	topicRenamesMu.Lock()
+	defer topicRenamesMu.Unlock()
+	for topic, deviceID := range deviceIDs {
+		if deviceID == id {
+			return topic
+		}
+	}
+	return id
+}
+
+// Move a device to a new topic. It keeps its ID, so its discovery topic and
+// unique IDs don't change and Home Assistant keeps its entities, history and
+// customizations. If the bridge knows the device, its discovery config is
+// updated with the new state topics right away and the old state topics are
+// cleared. Otherwise it's updated with its next webhook.
+func migrateDevice(discoveryPrefix string, from string, to string) error {
+	discoveryTopic := deviceDiscoveryTopic(discoveryPrefix, from)
+	unlock := deviceLocks.lock(discoveryTopic)
+	defer unlock()
+
+	topicRenamesMu.Lock()
+	id := from
+	if deviceID, ok := deviceIDs[from]; ok {
+		id = deviceID
+	}
+	topicRenames[from] = to
+	for old, current := range topicRenames {
+		// Follow devices that were renamed before
+		if current == from {
+			topicRenames[old] = to
+		}
+	}
+	// The new topic is in use now, even if it was renamed before
+	delete(topicRenames, to)
+	delete(deviceIDs, from)
+	if id != to {
+		deviceIDs[to] = id
+	} else {
+		delete(deviceIDs, to)
+	}
+	topicRenamesMu.Unlock()
+
+	mu.Lock()
+	cached, known := discoveryMessages[discoveryTopic]
+	mu.Unlock()
+	if !known {
+		return clearFlatTopic("", from)
+	}
+
+	// The new state topic has the old topic's levels replaced
+	levels := strings.Split(cached.StateTopic, "/")
+	for i, level := range levels {
+		if level == from {
+			levels[i] = to
+		}
+	}
+	u := stateUpdate{
+		topic:          to,
+		fullTopic:      strings.Join(levels, "/"),
+		discoveryTopic: discoveryTopic,
+		device:         cached.Device,
+	}
+	// Already moved, like a rename from TOPIC_RENAMES after a restart
+	if u.fullTopic == cached.StateTopic {
+		return nil
+	}
+
+	// Announce the same entities with the new state topics
+	payload := buildDiscoveryPayload(u)
+	payload.Components = make(map[string]Component, len(cached.Components))
+	for componentID := range cached.Components {
+		key := strings.TrimPrefix(componentID, id+"_")
+		if e := findEntity(key); e != nil {
+			payload.Components[componentID] = newComponent(to, u.fullTopic, *e)
+		}
+	}
+
+	messages, err := discoveryMessagesFor(u.discoveryTopic, payload)
+	if err != nil {
+		return err
+	}
+	for topic, jsonData := range messages {
+		if err := publishDiscovery(context.Background(), topic, jsonData); err != nil {
+			return err
+		}
+		logMessage(INFO, "Discovery message sent", "topic", topic)
+	}
+
+	mu.Lock()
+	cacheDiscovery(u.discoveryTopic, payload)
+	mu.Unlock()
+	saveDiscoveryCache()
+
+	if err := clearFlatTopic(cached.StateTopic, from); err != nil {
+		return err
+	}
+	return clearDeviceState(cached.StateTopic)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// A rule sending a message when a device's field changes to a value, like
+// call becoming active
+type notifyRule struct {
+	name    string
+	field   string
+	value   string
+	topics  map[string]bool
+	message *template.Template
+	targets []notifyTarget
+	// Waits for the field to settle before the rule is checked, nil to
+	// check it right away
+	debounce *debouncer
+	// Per topic MESSAGE_<TOPIC> and DEBOUNCE_<TOPIC> overrides, by template
+	// key
+	topicMessages map[string]*template.Template
+	topicDebounce map[string]*debouncer
+
+	mu sync.Mutex
+	// Settled value of the field per topic
+	settled map[string]string
+}
+
+// Where a rule's messages go: a Discord webhook, a Telegram chat or a
+// Matrix room
+type notifyTarget struct {
+	kind  string
+	url   string
+	token string
+	chat  string
+}
+
+var notifyRules []*notifyRule
+
+// Messages queued per rule and target so they're delivered in order
+var notifyQueue *deviceQueue
+
+// Telegram Bot API
+var telegramAPI = "https://api.telegram.org/"
+
+// Transaction IDs of Matrix messages sent since the bridge started
+var matrixTxnID uint64
+
+const defaultNotifyMessage = "{{ .topic }}: {{ .field }} is now {{ .value }}"
+
+// Prefix of the variables defining notification rules
+const notifyRulePrefix = "NOTIFY_RULE_"
+
+// Settings of a NOTIFY_RULE_<NAME>_<SETTING> variable
+var notifySettings = []string{"WHEN", "TOPICS", "MESSAGE", "DEBOUNCE", "DISCORD_URL", "TELEGRAM_TOKEN", "TELEGRAM_CHAT", "MATRIX_URL", "MATRIX_TOKEN", "MATRIX_ROOM"}
+
+// Settings that can be overridden for a single topic with a _<TOPIC> suffix
+var notifyTopicSettings = []string{"MESSAGE", "DEBOUNCE"}
+
+// Load the notification rules from the NOTIFY_RULE_<NAME>_<SETTING>
+// variables. Other NOTIFY_ variables are left alone.
+func loadNotifyRules() error {
+	settings := make(map[string]map[string]string)
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, notifyRulePrefix) || value == "" {
+			continue
+		}
+		rule, setting := splitNotifyVariable(strings.TrimPrefix(name, notifyRulePrefix))
+		if setting == "" || rule == "" {
+			return fmt.Errorf("%s: unknown setting, expected %s<NAME>_ followed by one of %s, or MESSAGE_<TOPIC> or DEBOUNCE_<TOPIC>",
+				name, notifyRulePrefix, strings.Join(notifySettings, ", "))
+		}
+		if settings[rule] == nil {
+			settings[rule] = make(map[string]string)
+		}
+		settings[rule][setting] = value
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rule, err := newNotifyRule(strings.ToLower(name), settings[name])
+		if err != nil {
+			return fmt.Errorf("%s%s: %v", notifyRulePrefix, name, err)
+		}
+		notifyRules = append(notifyRules, rule)
+		logMessage(DEBUG, "Loaded notification rule", "rule", rule.name)
+	}
+	if len(notifyRules) > 0 {
+		notifyQueue = newDeviceQueue(64, 4, true)
+	}
+	return nil
+}
+
+// Split a variable name without its prefix into the rule's name and the
+// setting, "" if it has none. Rule names may contain underscores themselves,
+// so the longest matching setting wins, and a per topic setting is split at
+// its last occurrence. Per topic settings are returned as MESSAGE_<topic key>.
+func splitNotifyVariable(name string) (string, string) {
+	var setting string
+	for _, s := range notifySettings {
+		if strings.HasSuffix(name, "_"+s) && len(s) > len(setting) {
+			setting = s
+		}
+	}
+	if setting != "" {
+		return strings.TrimSuffix(name, "_"+setting), setting
+	}
+
+	rule := ""
+	for _, s := range notifyTopicSettings {
+		i := strings.LastIndex(name, "_"+s+"_")
+		if i < 0 || i < len(rule) {
+			continue
+		}
+		topic := name[i+len(s)+2:]
+		if topic == "" {
+			continue
+		}
+		rule, setting = name[:i], s+"_"+templateKey(topic)
+	}
+	return rule, setting
+}
+
+// Build a rule from its settings
+func newNotifyRule(name string, settings map[string]string) (*notifyRule, error) {
+	rule := &notifyRule{name: name, topics: make(map[string]bool), settled: make(map[string]string),
+		topicMessages: make(map[string]*template.Template), topicDebounce: make(map[string]*debouncer)}
+
+	field, value, ok := strings.Cut(settings["WHEN"], ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("WHEN must be field:value, like call:active, got %q", settings["WHEN"])
+	}
+	rule.field, rule.value = strings.ToLower(strings.TrimSpace(field)), strings.TrimSpace(value)
+	switch rule.field {
+	case "control":
+	case "call", "mute", "record", "share", "video", "in_meeting":
+		rule.value = strings.ToLower(rule.value)
+		if !isStatusValue(rule.value) {
+			return nil, fmt.Errorf("unknown status %q, expected one of: %s", rule.value, strings.Join(statusValues, ", "))
+		}
+	default:
+		return nil, fmt.Errorf("unknown field %q", rule.field)
+	}
+
+	for _, topic := range strings.Split(settings["TOPICS"], ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			rule.topics[topic] = true
+		}
+	}
+
+	text := settings["MESSAGE"]
+	if text == "" {
+		text = defaultNotifyMessage
+	}
+	tmpl, err := parseNotifyMessage(name, "MESSAGE", text)
+	if err != nil {
+		return nil, err
+	}
+	rule.message = tmpl
+
+	if rule.debounce, err = parseNotifyDebounce("DEBOUNCE", settings["DEBOUNCE"]); err != nil {
+		return nil, err
+	}
+
+	for setting, value := range settings {
+		if key, ok := strings.CutPrefix(setting, "MESSAGE_"); ok {
+			if rule.topicMessages[key], err = parseNotifyMessage(name, setting, value); err != nil {
+				return nil, err
+			}
+		}
+		if key, ok := strings.CutPrefix(setting, "DEBOUNCE_"); ok {
+			if rule.topicDebounce[key], err = parseNotifyDebounce(setting, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if u := settings["DISCORD_URL"]; u != "" {
+		if err := validateOutboundURL(u); err != nil {
+			return nil, err
+		}
+		rule.targets = append(rule.targets, notifyTarget{kind: "discord", url: u})
+	}
+	if settings["TELEGRAM_TOKEN"] != "" || settings["TELEGRAM_CHAT"] != "" {
+		if settings["TELEGRAM_TOKEN"] == "" || settings["TELEGRAM_CHAT"] == "" {
+			return nil, fmt.Errorf("TELEGRAM_TOKEN and TELEGRAM_CHAT must both be set")
+		}
+		rule.targets = append(rule.targets, notifyTarget{kind: "telegram", token: settings["TELEGRAM_TOKEN"], chat: settings["TELEGRAM_CHAT"]})
+	}
+	if settings["MATRIX_URL"] != "" || settings["MATRIX_TOKEN"] != "" || settings["MATRIX_ROOM"] != "" {
+		if settings["MATRIX_URL"] == "" || settings["MATRIX_TOKEN"] == "" || settings["MATRIX_ROOM"] == "" {
+			return nil, fmt.Errorf("MATRIX_URL, MATRIX_TOKEN and MATRIX_ROOM must all be set")
+		}
+		if err := validateOutboundURL(settings["MATRIX_URL"]); err != nil {
+			return nil, err
+		}
+		rule.targets = append(rule.targets, notifyTarget{kind: "matrix", url: settings["MATRIX_URL"], token: settings["MATRIX_TOKEN"], chat: settings["MATRIX_ROOM"]})
+	}
+	if len(rule.targets) == 0 {
+		return nil, fmt.Errorf("no DISCORD_URL, TELEGRAM_TOKEN or MATRIX_URL to send messages to")
+	}
+	return rule, nil
+}
+
+// Parse one of a rule's message templates
+func parseNotifyMessage(rule string, setting string, text string) (*template.Template, error) {
+	return template.New(notifyRulePrefix + strings.ToUpper(rule) + "_" + strings.ToUpper(setting)).Funcs(templateFuncs).Parse(text)
+}
+
+// Create the debouncer of a DEBOUNCE setting, nil if it's unset or 0
+func parseNotifyDebounce(setting string, value string) (*debouncer, error) {
+	if value == "" {
+		return nil, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window < 0 {
+		return nil, fmt.Errorf("invalid %s: %q", setting, value)
+	}
+	if window == 0 {
+		return nil, nil
+	}
+	return newDebouncer(window), nil
+}
+
+// The message template and debouncer of a topic, its own if it has
+// overrides
+func (rule *notifyRule) messageFor(topic string) *template.Template {
+	if tmpl, ok := rule.topicMessages[templateKey(topic)]; ok {
+		return tmpl
+	}
+	return rule.message
+}
+
+func (rule *notifyRule) debouncerFor(topic string) *debouncer {
+	if d, ok := rule.topicDebounce[templateKey(topic)]; ok {
+		return d
+	}
+	return rule.debounce
+}
+
+// Check every rule against a published state
+func notifyState(u stateUpdate) {
+	for _, rule := range notifyRules {
+		if len(rule.topics) > 0 && !rule.topics[u.topic] {
+			continue
+		}
+		value, _ := u.state.fields()[rule.field].(string)
+		if value == "" || value == unknownValue || u.state.Omit[rule.field] {
+			continue
+		}
+		rule := rule
+		d := rule.debouncerFor(u.topic)
+		if d == nil {
+			rule.check(u, value)
+			continue
+		}
+		d.submit(u.topic, func() { rule.check(u, value) })
+	}
+}
+
+// Send the rule's message if a topic's field changed to the rule's value.
+// The first value seen for a topic only sets where it starts from, so a
+// restart doesn't repeat messages.
+func (rule *notifyRule) check(u stateUpdate, value string) {
+	rule.mu.Lock()
+	previous, seen := rule.settled[u.topic]
+	rule.settled[u.topic] = value
+	rule.mu.Unlock()
+	if !seen || previous == value || value != rule.value {
+		return
+	}
+
+	data := u.state.fields()
+	data["topic"] = u.topic
+	data["state_topic"] = u.fullTopic
+	data["field"] = rule.field
+	data["value"] = value
+	data["previous"] = previous
+	var message bytes.Buffer
+	if err := rule.messageFor(u.topic).Execute(&message, data); err != nil {
+		logMessage(ERROR, "Error applying message template of notification rule", "topic", u.topic, "rule", rule.name, "error", err)
+		return
+	}
+
+	for _, target := range rule.targets {
+		target := target
+		text := message.String()
+		if !notifyQueue.enqueue(rule.name+" "+target.kind, func() { sendNotification(rule.name, u.topic, target, text) }) {
+			logMessage(WARN, "Notification queue is full, dropping message", "topic", u.topic, "rule", rule.name)
+		}
+	}
+}
+
+// Deliver a message to a target
+func sendNotification(rule string, topic string, target notifyTarget, text string) {
+	var err error
+	switch target.kind {
+	case "discord":
+		err = postNotification(http.MethodPost, target.url, "", map[string]interface{}{"content": text})
+	case "telegram":
+		endpoint := fmt.Sprintf("%sbot%s/sendMessage", telegramAPI, target.token)
+		err = postNotification(http.MethodPost, endpoint, "", map[string]interface{}{"chat_id": target.chat, "text": text})
+	case "matrix":
+		endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/mutedeck2mqtt-%d-%d",
+			strings.TrimSuffix(target.url, "/"), url.PathEscape(target.chat), time.Now().Unix(), atomic.AddUint64(&matrixTxnID, 1))
+		err = postNotification(http.MethodPut, endpoint, target.token, map[string]interface{}{"msgtype": "m.text", "body": text})
+	}
+	if err != nil {
+		logMessage(ERROR, "Error sending notification", "topic", topic, "rule", rule, "target", target.kind, "error", err)
+		recordRecentError("notify", topic, fmt.Sprintf("%s %s: %v", rule, target.kind, err))
+		return
+	}
+	logMessage(DEBUG, "Sent notification", "topic", topic, "rule", rule, "target", target.kind)
+}
+
+// Send a JSON message, with a bearer token if one is given
+func postNotification(method string, endpoint string, token string, message map[string]interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := newOutboundRequest(method, endpoint, "application/json", body)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	// Errors only name the host, the Telegram URL contains the bot token
+	return sendOutbound(req, serviceTimeout, nil)
+}
+
+// Check the rules waiting for their debounce right away, for shutdown
+func flushNotifyRules() {
+	for _, rule := range notifyRules {
+		if rule.debounce != nil {
+			rule.debounce.flush()
+		}
+		for _, d := range rule.topicDebounce {
+			if d != nil {
+				d.flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A message that couldn't be published, kept until the broker is back
+type queuedMessage struct {
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	Payload  []byte    `json:"payload"`
+	Queued   time.Time `json:"queued"`
+
+	// Identifies the message while it's being replayed
+	seq uint64
+}
+
+// File states that couldn't be published are kept in until the broker is
+// back, empty to not keep them, and how many are kept at most
+var offlineQueueFile string
+var offlineQueueSize = 1000
+
+// Messages waiting for the broker, oldest first
+var offlineQueue []queuedMessage
+var offlineQueueMu sync.Mutex
+
+// Sequence number of the last queued message, lines in the file and whether
+// a replay is running, guarded by offlineQueueMu
+var offlineQueueSeq uint64
+var offlineQueueLines int
+var offlineReplaying bool
+
+// Delays between attempts to replay the queue while the broker can't be
+// reached
+var offlineReplayBackoff = backoff{initial: time.Second, max: time.Minute, retries: -1}
+
+// Load the messages queued by an earlier run from path, which must be
+// offlineQueueFile. The file is a log with one JSON message per line; a line
+// cut short by a crash is skipped. A missing file is not an error.
+func loadOfflineQueue(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var messages []queuedMessage
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		lines++
+		var m queuedMessage
+		if err := json.Unmarshal(line, &m); err != nil {
+			logMessage(WARN, "Skipping unreadable line of the offline queue", "path", path, "line", lines, "error", err)
+			continue
+		}
+		messages = append(messages, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	// Messages dropped from a full queue are still in the log
+	if len(messages) > offlineQueueSize {
+		messages = messages[len(messages)-offlineQueueSize:]
+	}
+
+	offlineQueueMu.Lock()
+	defer offlineQueueMu.Unlock()
+	offlineQueue = offlineQueue[:0]
+	for _, m := range messages {
+		offlineQueueSeq++
+		m.seq = offlineQueueSeq
+		offlineQueue = append(offlineQueue, m)
+	}
+	offlineQueueLines = lines
+	// Start from a clean file, a message appended after a cut short line
+	// would be unreadable too
+	if len(offlineQueue) < lines {
+		compactOfflineQueue()
+	}
+	if len(messages) > 0 {
+		logMessage(INFO, "Loaded queued messages", "count", len(messages), "path", path)
+	}
+	return nil
+}
+
+// Append a message to the file. Must be called with offlineQueueMu held.
+func appendOfflineQueue(m queuedMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(offlineQueueFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	offlineQueueLines++
+	return file.Close()
+}
+
+// Rewrite the file with only the messages still queued, so replayed and
+// dropped messages don't pile up in it. Must be called with offlineQueueMu
+// held.
+func compactOfflineQueue() {
+	var data bytes.Buffer
+	for _, m := range offlineQueue {
+		line, err := json.Marshal(m)
+		if err != nil {
+			logMessage(ERROR, "Error marshaling offline queue", "error", err)
+			return
+		}
+		data.Write(line)
+		data.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(offlineQueueFile), ".queue-*.tmp")
+	if err != nil {
+		logMessage(ERROR, "Error saving offline queue", "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data.Bytes()); err != nil {
+		tmp.Close()
+		logMessage(ERROR, "Error saving offline queue", "error", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		logMessage(ERROR, "Error saving offline queue", "error", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), offlineQueueFile); err != nil {
+		logMessage(ERROR, "Error saving offline queue", "error", err)
+		return
+	}
+	offlineQueueLines = len(offlineQueue)
+}
+
+// Add a message to the queue, dropping the oldest once it's full, and start
+// replaying it. Must be called with offlineQueueMu held.
+func queueMessage(topic string, qos byte, retained bool, payload []byte) {
+	if len(offlineQueue) >= offlineQueueSize {
+		logMessage(WARN, "Offline queue is full, dropping the oldest message", "topic", offlineQueue[0].Topic)
+		offlineQueue = append(offlineQueue[:0], offlineQueue[1:]...)
+	}
+	offlineQueueSeq++
+	m := queuedMessage{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Payload:  append([]byte(nil), payload...),
+		Queued:   time.Now().UTC(),
+		seq:      offlineQueueSeq,
+	}
+	offlineQueue = append(offlineQueue, m)
+
+	// Dropped messages are only removed from the file when it's compacted
+	if offlineQueueLines >= 2*offlineQueueSize {
+		compactOfflineQueue()
+	} else if err := appendOfflineQueue(m); err != nil {
+		logMessage(ERROR, "Error saving offline queue", "error", err)
+	}
+	if !offlineReplaying {
+		offlineReplaying = true
+		go replayOfflineQueue()
+	}
+}
+
+// Publish a state message, keeping it in the offline queue if the broker
+// can't be reached so it's published once the broker is back. While messages
+// are queued new ones are queued behind them to keep them in order. Without
+// an offline queue failed publishes are retried in the background instead.
+func publishOrQueue(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	if offlineQueueFile == "" {
+		return publishWithRetry(ctx, topic, qos, retained, payload)
+	}
+
+	offlineQueueMu.Lock()
+	if len(offlineQueue) > 0 {
+		queueMessage(topic, qos, retained, payload)
+		offlineQueueMu.Unlock()
+		logMessage(DEBUG, "Queued message behind others", "topic", topic, "count", len(offlineQueue)-1)
+		return nil
+	}
+	offlineQueueMu.Unlock()
+
+	err := publishContext(ctx, topic, qos, retained, payload)
+	if err == nil {
+		return nil
+	}
+
+	offlineQueueMu.Lock()
+	defer offlineQueueMu.Unlock()
+	queueMessage(topic, qos, retained, payload)
+	logMessage(WARN, "Queued message until the broker is back", "topic", topic, "error", err)
+	return nil
+}
+
+// Start replaying the queue in the background unless a replay is already
+// running
+func startOfflineReplay() {
+	offlineQueueMu.Lock()
+	defer offlineQueueMu.Unlock()
+	if offlineReplaying || len(offlineQueue) == 0 {
+		return
+	}
+	offlineReplaying = true
+	go replayOfflineQueue()
+}
+
+// Publish the queued messages in order, and if one fails try again with
+// offlineReplayBackoff's delays until the queue is empty. Run when the
+// primary broker connects and when a message is queued.
+func replayOfflineQueue() {
+	defer recoverGoroutine("offline queue replay")
+	defer func() {
+		offlineQueueMu.Lock()
+		offlineReplaying = false
+		offlineQueueMu.Unlock()
+	}()
+
+	retry(context.Background(), offlineReplayBackoff, "replaying the offline queue", func() error {
+		err := replayQueuedMessages()
+		// Publishing paused by the circuit breaker is retried too, the replay
+		// is what lets it try the broker again
+		if errors.Is(err, errCircuitOpen) {
+			return fmt.Errorf("publishing is paused")
+		}
+		return err
+	})
+}
+
+// Publish the queued messages in order, stopping at the first failure. The
+// queue isn't locked while a message is published, so new messages can be
+// queued behind it meanwhile.
+func replayQueuedMessages() error {
+	replayed := 0
+	defer func() {
+		if replayed == 0 {
+			return
+		}
+		offlineQueueMu.Lock()
+		compactOfflineQueue()
+		offlineQueueMu.Unlock()
+		logMessage(INFO, "Replayed queued messages", "count", replayed)
+	}()
+
+	for {
+		offlineQueueMu.Lock()
+		if len(offlineQueue) == 0 {
+			offlineQueue = nil
+			offlineQueueMu.Unlock()
+			return nil
+		}
+		m := offlineQueue[0]
+		offlineQueueMu.Unlock()
+
+		if err := publish(m.Topic, m.QoS, m.Retained, m.Payload); err != nil {
+			offlineQueueMu.Lock()
+			queued := len(offlineQueue)
+			offlineQueueMu.Unlock()
+			return fmt.Errorf("%s, %d messages still queued: %w", m.Topic, queued, err)
+		}
+
+		offlineQueueMu.Lock()
+		// A full queue may have dropped the message while it was published
+		if len(offlineQueue) > 0 && offlineQueue[0].seq == m.seq {
+			offlineQueue = offlineQueue[1:]
+		}
+		offlineQueueMu.Unlock()
+		replayed++
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A broker client recording what's published, failing the topics in fail
+type fakeClient struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	published []string
+	fail      map[string]bool
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail[topic] {
+		return fakeToken{err: errors.New("broker hiccup")}
+	}
+	c.published = append(c.published, topic)
+	return fakeToken{}
+}
+
+type fakeToken struct {
+	err error
+}
+
+func (t fakeToken) Wait() bool                     { return true }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (t fakeToken) Error() error { return t.err }
+
+// Point the offline queue at a file in a temporary directory, without
+// starting replays, and restore it afterwards
+func useOfflineQueue(t *testing.T, size int) string {
+	t.Helper()
+	savedFile, savedSize := offlineQueueFile, offlineQueueSize
+	t.Cleanup(func() {
+		offlineQueueMu.Lock()
+		defer offlineQueueMu.Unlock()
+		offlineQueueFile, offlineQueueSize = savedFile, savedSize
+		offlineQueue, offlineQueueLines, offlineReplaying = nil, 0, false
+	})
+	offlineQueueMu.Lock()
+	defer offlineQueueMu.Unlock()
+	offlineQueueFile = filepath.Join(t.TempDir(), "queue.jsonl")
+	offlineQueueSize = size
+	offlineQueue, offlineQueueLines = nil, 0
+	// Replays are run by the tests themselves
+	offlineReplaying = true
+	return offlineQueueFile
+}
+
+// Topics of the messages in the queue file
+func queueFileTopics(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var topics []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var m queuedMessage
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("unreadable line %q: %v", line, err)
+		}
+		topics = append(topics, m.Topic)
+	}
+	return topics
+}
+
+func queueTopics() []string {
+	offlineQueueMu.Lock()
+	defer offlineQueueMu.Unlock()
+	var topics []string
+	for _, m := range offlineQueue {
+		topics = append(topics, m.Topic)
+	}
+	return topics
+}
+
+func queueLine(topic string) string {
+	data, _ := json.Marshal(queuedMessage{Topic: topic, Payload: []byte("{}")})
+	return string(data) + "\n"
+}
+
+func TestLoadOfflineQueue(t *testing.T) {
+	tests := []struct {
+		name string
+		// File contents, none for a missing file
+		file      *string
+		want      []string
+		compacted bool
+	}{
+		{name: "missing file"},
+		{name: "every line read", file: ptr(queueLine("a") + queueLine("b")), want: []string{"a", "b"}},
+		{name: "blank lines ignored", file: ptr(queueLine("a") + "\n\n" + queueLine("b")), want: []string{"a", "b"}},
+		{name: "line cut short by a crash", file: ptr(queueLine("a") + queueLine("b") + `{"topic":"c","pay`), want: []string{"a", "b"}, compacted: true},
+		{name: "unreadable line in the middle", file: ptr(queueLine("a") + "garbage\n" + queueLine("b")), want: []string{"a", "b"}, compacted: true},
+		{name: "newest kept when over the size", file: ptr(queueLine("a") + queueLine("b") + queueLine("c") + queueLine("d")), want: []string{"b", "c", "d"}, compacted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useOfflineQueue(t, 3)
+			if tt.file != nil {
+				if err := os.WriteFile(path, []byte(*tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := loadOfflineQueue(path); err != nil {
+				t.Fatal(err)
+			}
+			if got := queueTopics(); !slices.Equal(got, tt.want) {
+				t.Errorf("queue has %v, want %v", got, tt.want)
+			}
+			if tt.compacted {
+				if got := queueFileTopics(t, path); !slices.Equal(got, tt.want) {
+					t.Errorf("file has %v after loading, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueMessageAppendsAndCompacts(t *testing.T) {
+	path := useOfflineQueue(t, 2)
+
+	offlineQueueMu.Lock()
+	defer offlineQueueMu.Unlock()
+	steps := []struct {
+		topic string
+		queue []string
+		file  []string
+	}{
+		{"a", []string{"a"}, []string{"a"}},
+		{"b", []string{"a", "b"}, []string{"a", "b"}},
+		// The dropped message stays in the log until it's compacted
+		{"c", []string{"b", "c"}, []string{"a", "b", "c"}},
+		{"d", []string{"c", "d"}, []string{"a", "b", "c", "d"}},
+		{"e", []string{"d", "e"}, []string{"d", "e"}},
+	}
+	for _, step := range steps {
+		queueMessage(step.topic, 0, true, []byte("{}"))
+		var queued []string
+		for _, m := range offlineQueue {
+			queued = append(queued, m.Topic)
+		}
+		if !slices.Equal(queued, step.queue) {
+			t.Errorf("after queuing %s the queue has %v, want %v", step.topic, queued, step.queue)
+		}
+		if got := queueFileTopics(t, path); !slices.Equal(got, step.file) {
+			t.Errorf("after queuing %s the file has %v, want %v", step.topic, got, step.file)
+		}
+	}
+}
+
+func TestReplayQueuedMessages(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      map[string]bool
+		published []string
+		left      []string
+	}{
+		{name: "every message replayed in order", published: []string{"a", "b", "c"}},
+		{name: "stops at the first failure", fail: map[string]bool{"b": true}, published: []string{"a"}, left: []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useOfflineQueue(t, 10)
+			client := &fakeClient{fail: tt.fail}
+			savedBrokers, savedCircuit := brokers, publishCircuit
+			defer func() { brokers, publishCircuit = savedBrokers, savedCircuit }()
+			brokers = []*broker{{name: "primary", client: client, connected: true}}
+			publishCircuit = &circuitBreaker{threshold: 100, cooldown: time.Minute}
+
+			offlineQueueMu.Lock()
+			for _, topic := range []string{"a", "b", "c"} {
+				queueMessage(topic, 0, true, []byte("{}"))
+			}
+			offlineQueueMu.Unlock()
+
+			err := replayQueuedMessages()
+			if (err != nil) != (len(tt.left) > 0) {
+				t.Errorf("got error %v", err)
+			}
+			if !slices.Equal(client.published, tt.published) {
+				t.Errorf("published %v, want %v", client.published, tt.published)
+			}
+			if got := queueTopics(); !slices.Equal(got, tt.left) {
+				t.Errorf("queue has %v left, want %v", got, tt.left)
+			}
+			if got := queueFileTopics(t, path); !slices.Equal(got, tt.left) {
+				t.Errorf("file has %v left, want %v", got, tt.left)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client for every request the bridge makes to other services: MuteDeck's
+// API and callbacks, forwards, Home Assistant, InfluxDB, Slack,
+// notifications and busy lights. Each request gets its own timeout.
+var outboundClient = &http.Client{}
+
+// Timeouts of requests to devices on the local network, and to other
+// services
+const localTimeout = 5 * time.Second
+const serviceTimeout = 10 * time.Second
+
+// A response with a status other than 2xx
+type statusError struct {
+	host   string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned %s", e.host, e.status)
+}
+
+// Check that a URL the bridge sends requests to is an http or https URL
+func validateOutboundURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("URL must be an http or https URL, got %q", target)
+	}
+	return nil
+}
+
+// Create a request to another service with a body of the given content type,
+// no body if it's nil
+func newOutboundRequest(method string, target string, contentType string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// Send a request to another service, failing if it takes longer than timeout
+// or isn't answered with 2xx. handle reads a successful response, nil to
+// ignore it. Errors name the host rather than the URL, which may contain a
+// token.
+func sendOutbound(req *http.Request, timeout time.Duration, handle func(*http.Response) error) error {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	resp, err := outboundClient.Do(req.WithContext(ctx))
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("%s: %w", req.URL.Host, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{host: req.URL.Host, status: resp.Status, code: resp.StatusCode}
+	}
+	if handle != nil {
+		return handle(resp)
+	}
+	return nil
+}
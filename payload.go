@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// State sent by MuteDeck's webhook
+type MuteDeckState struct {
+	Call    string `json:"call"`
+	Control string `json:"control"`
+	Mute    string `json:"mute"`
+	Record  string `json:"record"`
+	Share   string `json:"share"`
+	Video   string `json:"video"`
+
+	// Whether the user is in a meeting, derived from call
+	InMeeting string `json:"in_meeting"`
+
+	// When the current meeting started and how many seconds ago, with
+	// MEETING_TRACKING
+	MeetingStartedAt string `json:"meeting_started_at,omitempty"`
+	MeetingDuration  *int64 `json:"meeting_duration,omitempty"`
+
+	// Webhook schema version the payload was detected as
+	SchemaVersion int `json:"schema_version,omitempty"`
+
+	// When the bridge published the state and its position in the sequence of
+	// published states
+	LastUpdated string `json:"last_updated,omitempty"`
+	Seq         uint64 `json:"seq,omitempty"`
+
+	// Fields the bridge doesn't know about, published as they are
+	Extra map[string]interface{} `json:"-"`
+
+	// Fields left out of the published state
+	Omit map[string]bool `json:"-"`
+}
+
+// Marshal the known fields together with any extra fields
+func (s MuteDeckState) MarshalJSON() ([]byte, error) {
+	type known MuteDeckState
+	if len(s.Extra) == 0 && len(s.Omit) == 0 {
+		return json.Marshal(known(s))
+	}
+	return json.Marshal(s.fields())
+}
+
+// All fields of the state, known and extra, by key
+func (s MuteDeckState) fields() map[string]interface{} {
+	fields := make(map[string]interface{}, len(s.Extra)+len(stateKeys))
+	for key, value := range s.Extra {
+		fields[key] = value
+	}
+	fields["call"] = s.Call
+	fields["control"] = s.Control
+	fields["mute"] = s.Mute
+	fields["record"] = s.Record
+	fields["share"] = s.Share
+	fields["video"] = s.Video
+	fields["in_meeting"] = s.InMeeting
+	if s.MeetingDuration != nil {
+		fields["meeting_started_at"] = s.MeetingStartedAt
+		fields["meeting_duration"] = *s.MeetingDuration
+	}
+	// Like the JSON state, which leaves it out when it's unset
+	if s.SchemaVersion != 0 {
+		fields["schema_version"] = s.SchemaVersion
+	}
+	if s.LastUpdated != "" {
+		fields["last_updated"] = s.LastUpdated
+		fields["seq"] = s.Seq
+	}
+	for key := range s.Omit {
+		delete(fields, key)
+	}
+	return fields
+}
+
+// Names of the fields published to their own topics, sorted. A name that
+// isn't a single topic level is skipped, so a payload can't pick a topic
+// outside its device's.
+func fieldKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if validateTopicLevel("field name", key) == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Convert a field to a simple payload for its own topic. Status values
+// become ON when active and OFF otherwise.
+func fieldPayload(value interface{}) []byte {
+	if s, ok := value.(string); ok {
+		switch s {
+		case "active":
+			return []byte("ON")
+		case "inactive", "disabled", "hidden":
+			return []byte("OFF")
+		}
+		return []byte(s)
+	}
+	data, _ := json.Marshal(value)
+	return data
+}
+
+// Values MuteDeck uses for the status fields
+var statusValues = []string{"active", "inactive", "disabled", "hidden"}
+
+// Other spellings of the status values, extended by STATUS_ALIASES
+var statusAliases = map[string]string{
+	"on":            "active",
+	"true":          "active",
+	"yes":           "active",
+	"1":             "active",
+	"enabled":       "active",
+	"off":           "inactive",
+	"false":         "inactive",
+	"no":            "inactive",
+	"0":             "inactive",
+	"unavailable":   "disabled",
+	"not_available": "disabled",
+	"n/a":           "disabled",
+	"invisible":     "hidden",
+}
+
+// Parse a comma separated list of value=status aliases into statusAliases
+func parseStatusAliases(list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		value, status, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("expected value=status, got %q", entry)
+		}
+		status = strings.ToLower(strings.TrimSpace(status))
+		if !isStatusValue(status) {
+			return fmt.Errorf("unknown status %q, expected one of: %s", status, strings.Join(statusValues, ", "))
+		}
+		statusAliases[strings.ToLower(strings.TrimSpace(value))] = status
+	}
+	return nil
+}
+
+// Convert a status value to its canonical spelling
+func normalizeStatus(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if status, ok := statusAliases[value]; ok {
+		return status
+	}
+	return value
+}
+
+// Value used for optional keys missing from the payload
+const unknownValue = "unknown"
+
+// Keys MuteDeck sends in every payload
+var stateKeys = []string{"call", "control", "mute", "record", "share", "video"}
+
+// Keys a payload must contain, any other missing key is set to unknown
+var requiredKeys = map[string]bool{"call": true, "control": true, "mute": true, "record": true, "share": true, "video": true}
+
+// Parse a comma separated list of required keys
+func parseRequiredKeys(list string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	for _, key := range strings.Split(list, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		if !isStateKey(key) {
+			return nil, fmt.Errorf("unknown key %q, expected one of: %s", key, strings.Join(stateKeys, ", "))
+		}
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// Reject bodies without a Content-Type header
+var requireContentType = false
+
+// Returned for bodies in a format the bridge can't read
+var errUnsupportedMediaType = errors.New("unsupported content type")
+
+// Convert a webhook body to JSON according to its content type. Form bodies
+// and plain key=value bodies become a JSON object of strings, a key given
+// more than once keeps its first value. Bodies without a content type are
+// read as JSON unless one is required.
+func bodyToJSON(contentType string, body []byte) ([]byte, error) {
+	if contentType == "" {
+		if requireContentType {
+			return nil, fmt.Errorf("%w: missing Content-Type", errUnsupportedMediaType)
+		}
+		return body, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnsupportedMediaType, err)
+	}
+
+	var values map[string]string
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return body, nil
+	case mediaType == "application/x-www-form-urlencoded":
+		// Some senders label JSON as a form
+		if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+			return body, nil
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid form body: %v", err)
+		}
+		values = make(map[string]string, len(form))
+		// Repeated keys keep their first value, like url.Values.Get
+		for key, value := range form {
+			values[key] = value[0]
+		}
+	case mediaType == "text/plain":
+		values = parseKeyValues(string(body))
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedMediaType, mediaType)
+	}
+	return json.Marshal(values)
+}
+
+// Parse key=value pairs separated by newlines or &, keeping the first value
+// of a repeated key
+func parseKeyValues(body string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.FieldsFunc(body, func(c rune) bool { return c == '\n' || c == '\r' || c == '&' }) {
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if _, seen := values[key]; !ok || key == "" || seen {
+			continue
+		}
+		values[key] = strings.TrimSpace(value)
+	}
+	return values
+}
+
+// Highest webhook schema version the bridge knows
+const latestSchemaVersion = 2
+
+// Work out which schema a payload uses and return its fields in the version
+// 1 layout. Version 1 is the flat object MuteDeck sends today, version 2
+// nests the status fields in a "state" object. A payload can also name its
+// version in a "schema_version" field. Payloads from unknown newer versions
+// are parsed as the closest known version rather than rejected.
+func decodeSchema(body []byte) (map[string]json.RawMessage, int, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	version := 1
+	var nested map[string]json.RawMessage
+	if value, ok := raw["state"]; ok && json.Unmarshal(value, &nested) == nil {
+		version = 2
+	}
+	if value, ok := raw["schema_version"]; ok {
+		var explicit json.Number
+		if err := json.Unmarshal(value, &explicit); err != nil {
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return nil, 0, fmt.Errorf("schema_version must be a number, got %s", value)
+			}
+			explicit = json.Number(s)
+		}
+		v, err := explicit.Int64()
+		if err != nil || v < 1 {
+			return nil, 0, fmt.Errorf("invalid schema_version: %s", value)
+		}
+		version = int(v)
+		delete(raw, "schema_version")
+	}
+	if version > latestSchemaVersion {
+		logMessage(WARN, "Payload uses an unknown schema version, parsing it as the latest", "schema_version", version, "latest", latestSchemaVersion)
+	}
+
+	// Lift the nested status fields to the top level
+	if version >= 2 && nested != nil {
+		delete(raw, "state")
+		for key, value := range nested {
+			raw[key] = value
+		}
+	}
+
+	return raw, version, nil
+}
+
+// Parse and validate a webhook body. Every problem found is returned, not
+// just the first one.
+func parseState(body []byte) (MuteDeckState, []string) {
+	var state MuteDeckState
+
+	raw, version, err := decodeSchema(body)
+	if err != nil {
+		return state, []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	state.SchemaVersion = version
+
+	var problems []string
+	fields := []struct {
+		key    string
+		value  *string
+		status bool
+	}{
+		{"call", &state.Call, true},
+		{"control", &state.Control, false},
+		{"mute", &state.Mute, true},
+		{"record", &state.Record, true},
+		{"share", &state.Share, true},
+		{"video", &state.Video, true},
+	}
+	for _, field := range fields {
+		value, ok := raw[field.key]
+		if !ok {
+			if requiredKeys[field.key] {
+				problems = append(problems, fmt.Sprintf("missing required key: %s", field.key))
+			}
+			*field.value = unknownValue
+			continue
+		}
+		if err := json.Unmarshal(value, field.value); err != nil || string(value) == "null" {
+			problems = append(problems, fmt.Sprintf("%s must be a string, got %s", field.key, value))
+			continue
+		}
+		if field.status {
+			*field.value = normalizeStatus(*field.value)
+		}
+		if field.status && !isStatusValue(*field.value) {
+			problems = append(problems, fmt.Sprintf("%s has invalid value %q, expected one of: %s", field.key, *field.value, strings.Join(statusValues, ", ")))
+		}
+	}
+
+	state.InMeeting = meetingStatus(state.Call)
+
+	// Keep unknown fields so they are published too. Their names end up in
+	// topics and entity IDs, so ones that can't be a topic level are dropped.
+	for key, value := range raw {
+		if isStateKey(key) {
+			continue
+		}
+		if err := validateTopicLevel("field name", key); err != nil {
+			logMessage(WARN, "Dropping unknown field with an unsafe name", "field", key, "error", err)
+			continue
+		}
+		var extra interface{}
+		if err := json.Unmarshal(value, &extra); err != nil {
+			continue
+		}
+		if state.Extra == nil {
+			state.Extra = make(map[string]interface{})
+		}
+		state.Extra[key] = extra
+	}
+
+	return state, problems
+}
+
+// Whether a call status means the user is in a meeting
+func meetingStatus(call string) string {
+	switch call {
+	case "active":
+		return "active"
+	case unknownValue:
+		return unknownValue
+	}
+	return "inactive"
+}
+
+func isStateKey(key string) bool {
+	for _, stateKey := range stateKeys {
+		if key == stateKey {
+			return true
+		}
+	}
+	return false
+}
+
+func isStatusValue(value string) bool {
+	for _, allowed := range statusValues {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
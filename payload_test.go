@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseState(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		want     MuteDeckState
+		problems []string
+	}{
+		{
+			name: "version 1",
+			body: `{"call":"active","control":"zoom","mute":"inactive","record":"inactive","share":"disabled","video":"hidden"}`,
+			want: MuteDeckState{Call: "active", Control: "zoom", Mute: "inactive", Record: "inactive", Share: "disabled", Video: "hidden", InMeeting: "active", SchemaVersion: 1},
+		},
+		{
+			name: "version 2 nests the status fields",
+			body: `{"state":{"call":"inactive","control":"teams","mute":"active","record":"inactive","share":"inactive","video":"active"}}`,
+			want: MuteDeckState{Call: "inactive", Control: "teams", Mute: "active", Record: "inactive", Share: "inactive", Video: "active", InMeeting: "inactive", SchemaVersion: 2},
+		},
+		{
+			name: "explicit schema version as a string",
+			body: `{"schema_version":"1","call":"active","control":"zoom","mute":"active","record":"active","share":"active","video":"active"}`,
+			want: MuteDeckState{Call: "active", Control: "zoom", Mute: "active", Record: "active", Share: "active", Video: "active", InMeeting: "active", SchemaVersion: 1},
+		},
+		{
+			name: "aliases are normalized",
+			body: `{"call":"ON","control":"zoom","mute":"false","record":"0","share":"n/a","video":"Invisible"}`,
+			want: MuteDeckState{Call: "active", Control: "zoom", Mute: "inactive", Record: "inactive", Share: "disabled", Video: "hidden", InMeeting: "active", SchemaVersion: 1},
+		},
+		{
+			name:     "every problem is reported",
+			body:     `{"call":"ringing","control":"zoom","mute":true,"record":null,"share":"inactive"}`,
+			problems: []string{"call has invalid value", "mute must be a string", "record must be a string", "missing required key: video"},
+		},
+		{
+			name:     "invalid JSON",
+			body:     `{"call":`,
+			problems: []string{"invalid JSON"},
+		},
+		{
+			name:     "invalid schema version",
+			body:     `{"schema_version":0,"call":"active","control":"zoom","mute":"active","record":"active","share":"active","video":"active"}`,
+			problems: []string{"invalid JSON: invalid schema_version"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problems := parseState([]byte(tt.body))
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("got problems %q, want %d containing %q", problems, len(tt.problems), tt.problems)
+			}
+			for i, want := range tt.problems {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %d is %q, want it to contain %q", i, problems[i], want)
+				}
+			}
+			if len(tt.problems) > 0 {
+				return
+			}
+			if got.Call != tt.want.Call || got.Control != tt.want.Control || got.Mute != tt.want.Mute || got.Record != tt.want.Record ||
+				got.Share != tt.want.Share || got.Video != tt.want.Video || got.InMeeting != tt.want.InMeeting || got.SchemaVersion != tt.want.SchemaVersion {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStateOptionalKeys(t *testing.T) {
+	saved := requiredKeys
+	defer func() { requiredKeys = saved }()
+	requiredKeys = map[string]bool{"call": true}
+
+	got, problems := parseState([]byte(`{"call":"inactive"}`))
+	if len(problems) > 0 {
+		t.Fatalf("got problems %q", problems)
+	}
+	for key, value := range map[string]string{"control": got.Control, "mute": got.Mute, "video": got.Video} {
+		if value != unknownValue {
+			t.Errorf("%s is %q, want %q", key, value, unknownValue)
+		}
+	}
+}
+
+func TestParseStateKeepsExtraFields(t *testing.T) {
+	got, problems := parseState([]byte(`{"call":"active","control":"zoom","mute":"active","record":"active","share":"active","video":"active","hand":"active","volume":42}`))
+	if len(problems) > 0 {
+		t.Fatalf("got problems %q", problems)
+	}
+	if got.Extra["hand"] != "active" || got.Extra["volume"] != float64(42) {
+		t.Errorf("got extra fields %v, want hand and volume", got.Extra)
+	}
+}
+
+func TestParseStateDropsUnsafeExtraFields(t *testing.T) {
+	got, problems := parseState([]byte(`{"call":"active","control":"zoom","mute":"active","record":"active","share":"active","video":"active",` +
+		`"hand":"active","laptop/mute":"ON","+":1,"#":1,"":1,"$SYS":1,"nul\u0000":1}`))
+	if len(problems) > 0 {
+		t.Fatalf("got problems %q", problems)
+	}
+	if len(got.Extra) != 1 || got.Extra["hand"] != "active" {
+		t.Errorf("got extra fields %v, want only hand", got.Extra)
+	}
+}
+
+func TestFieldsLeaveOutUnsetSchemaVersion(t *testing.T) {
+	tests := []struct {
+		version int
+		want    bool
+	}{
+		{0, false},
+		{1, true},
+	}
+	for _, tt := range tests {
+		_, ok := MuteDeckState{SchemaVersion: tt.version}.fields()["schema_version"]
+		if ok != tt.want {
+			t.Errorf("schema version %d: fields has schema_version %v, want %v", tt.version, ok, tt.want)
+		}
+	}
+}
+
+func TestFieldKeysStayUnderTheDevice(t *testing.T) {
+	state, problems := parseState([]byte(`{"call":"active","control":"zoom","mute":"active","record":"active","share":"active","video":"active","laptop/mute":"ON"}`))
+	if len(problems) > 0 {
+		t.Fatalf("got problems %q", problems)
+	}
+	// A field added after parsing is checked too
+	state.Extra = map[string]interface{}{"cmd/clear_device": "laptop", "hand": "active"}
+
+	want := []string{"call", "control", "hand", "in_meeting", "mute", "record", "schema_version", "share", "video"}
+	if got := fieldKeys(state.fields()); !slices.Equal(got, want) {
+		t.Errorf("got field topics %v, want %v", got, want)
+	}
+}
+
+func TestBodyToJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		// Expected JSON, empty for an error
+		want        string
+		unsupported bool
+	}{
+		{name: "JSON", contentType: "application/json", body: `{"call":"active"}`, want: `{"call":"active"}`},
+		{name: "JSON with a charset", contentType: "application/json; charset=utf-8", body: `{"call":"active"}`, want: `{"call":"active"}`},
+		{name: "JSON suffix", contentType: "application/vnd.mutedeck+json", body: `{"call":"active"}`, want: `{"call":"active"}`},
+		{name: "no content type", body: `{"call":"active"}`, want: `{"call":"active"}`},
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: "call=active&control=google-meet&mute=in%20active", want: `{"call":"active","control":"google-meet","mute":"in active"}`},
+		{name: "form with a repeated key", contentType: "application/x-www-form-urlencoded", body: "call=active&call=inactive", want: `{"call":"active"}`},
+		{name: "JSON labelled as a form", contentType: "application/x-www-form-urlencoded", body: ` {"call":"active"}`, want: ` {"call":"active"}`},
+		{name: "JSON array labelled as a form", contentType: "application/x-www-form-urlencoded", body: `[{"call":"active"}]`, want: `[{"call":"active"}]`},
+		{name: "invalid form", contentType: "application/x-www-form-urlencoded", body: "call=%zz"},
+		{name: "text lines", contentType: "text/plain", body: "call = active\r\nmute=inactive\n\nvideo=", want: `{"call":"active","mute":"inactive","video":""}`},
+		{name: "text pairs", contentType: "text/plain", body: "call=active&mute=inactive", want: `{"call":"active","mute":"inactive"}`},
+		{name: "text with a repeated key", contentType: "text/plain", body: "call=active\ncall=inactive", want: `{"call":"active"}`},
+		{name: "text without values", contentType: "text/plain", body: "call\n=active", want: `{}`},
+		{name: "other content type", contentType: "application/xml", body: "<call/>", unsupported: true},
+		{name: "invalid content type", contentType: "text/", body: "call=active", unsupported: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bodyToJSON(tt.contentType, []byte(tt.body))
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				if errors.Is(err, errUnsupportedMediaType) != tt.unsupported {
+					t.Errorf("got error %v, want unsupported %v", err, tt.unsupported)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyToJSONRequiresContentType(t *testing.T) {
+	saved := requireContentType
+	defer func() { requireContentType = saved }()
+	requireContentType = true
+
+	if _, err := bodyToJSON("", []byte(`{"call":"active"}`)); !errors.Is(err, errUnsupportedMediaType) {
+		t.Errorf("got error %v, want %v", err, errUnsupportedMediaType)
+	}
+}
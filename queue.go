@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Jobs of every device in one bounded queue, run by a fixed number of
+// workers. A device's jobs run one at a time in the order they were queued,
+// while other devices' jobs run alongside them.
+type deviceQueue struct {
+	size int
+	// Drop the oldest job when the queue is full instead of the new one
+	dropOldest bool
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	jobs []queuedJob
+	// Devices with a job running
+	busy map[string]bool
+	// Jobs queued or running
+	pending sync.WaitGroup
+}
+
+type queuedJob struct {
+	key string
+	job func()
+}
+
+func newDeviceQueue(size int, workers int, dropOldest bool) *deviceQueue {
+	q := &deviceQueue{size: size, dropOldest: dropOldest, busy: make(map[string]bool)}
+	q.cond = sync.NewCond(&q.mu)
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+	return q
+}
+
+// Queue a job for a device, returns false if the queue is full. With
+// dropOldest the device's oldest job, or the oldest job of all if it has
+// none, is dropped to make room instead.
+func (q *deviceQueue) enqueue(key string, job func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.jobs) >= q.size {
+		if !q.dropOldest {
+			return false
+		}
+		oldest := 0
+		for i, j := range q.jobs {
+			if j.key == key {
+				oldest = i
+				break
+			}
+		}
+		logMessage(WARN, "Queue is full, dropped the oldest job", "key", q.jobs[oldest].key)
+		q.jobs = append(q.jobs[:oldest], q.jobs[oldest+1:]...)
+		q.pending.Done()
+	}
+
+	q.pending.Add(1)
+	q.jobs = append(q.jobs, queuedJob{key: key, job: job})
+	q.cond.Broadcast()
+	return true
+}
+
+// Wait until every queued job ran, returns false if ctx ended first
+func (q *deviceQueue) wait(ctx context.Context) bool {
+	return waitContext(ctx, &q.pending)
+}
+
+// Wait for a wait group, returns false if ctx ended first
+func waitContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Run the oldest job whose device has no job running, one after the other
+func (q *deviceQueue) run() {
+	for {
+		q.mu.Lock()
+		next := q.next()
+		for next < 0 {
+			q.cond.Wait()
+			next = q.next()
+		}
+		j := q.jobs[next]
+		q.jobs = append(q.jobs[:next], q.jobs[next+1:]...)
+		q.busy[j.key] = true
+		q.mu.Unlock()
+
+		runRecovered("queued job for "+j.key, j.job)
+
+		q.mu.Lock()
+		delete(q.busy, j.key)
+		// The device's next job may be waiting for this one
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		q.pending.Done()
+	}
+}
+
+// Index of the oldest job that can run, -1 if none can
+func (q *deviceQueue) next() int {
+	for i, j := range q.jobs {
+		if !q.busy[j.key] {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeviceQueueKeepsOrderPerDevice(t *testing.T) {
+	q := newDeviceQueue(1000, 4, false)
+
+	var mu sync.Mutex
+	ran := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"laptop", "desktop", "tablet"} {
+			i, key := i, key
+			if !q.enqueue(key, func() {
+				mu.Lock()
+				ran[key] = append(ran[key], i)
+				mu.Unlock()
+			}) {
+				t.Fatalf("queue rejected job %d of %s", i, key)
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !q.wait(ctx) {
+		t.Fatal("jobs didn't finish")
+	}
+
+	for key, values := range ran {
+		if len(values) != 100 {
+			t.Errorf("%s ran %d jobs, want 100", key, len(values))
+		}
+		for n := 1; n < len(values); n++ {
+			if values[n] != values[n-1]+1 {
+				t.Fatalf("%s ran job %d after job %d", key, values[n], values[n-1])
+			}
+		}
+	}
+}
+
+func TestDeviceQueueFull(t *testing.T) {
+	tests := []struct {
+		name       string
+		dropOldest bool
+		accepted   bool
+		want       []string
+	}{
+		{"reject", false, false, []string{"blocker", "laptop 1", "desktop 1"}},
+		{"drop oldest", true, true, []string{"blocker", "desktop 1", "laptop 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newDeviceQueue(2, 1, tt.dropOldest)
+
+			var mu sync.Mutex
+			var ran []string
+			record := func(name string) func() {
+				return func() {
+					mu.Lock()
+					ran = append(ran, name)
+					mu.Unlock()
+				}
+			}
+			// Keep the only worker busy while the queue fills up
+			release := make(chan struct{})
+			started := make(chan struct{})
+			q.enqueue("blocker", func() {
+				close(started)
+				<-release
+				record("blocker")()
+			})
+			<-started
+			q.enqueue("laptop", record("laptop 1"))
+			q.enqueue("desktop", record("desktop 1"))
+			if accepted := q.enqueue("laptop", record("laptop 2")); accepted != tt.accepted {
+				t.Fatalf("enqueue on a full queue returned %v, want %v", accepted, tt.accepted)
+			}
+			close(release)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !q.wait(ctx) {
+				t.Fatal("jobs didn't finish")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(ran) != len(tt.want) {
+				t.Fatalf("ran %v, want %v", ran, tt.want)
+			}
+			for i := range ran {
+				if ran[i] != tt.want[i] {
+					t.Fatalf("ran %v, want %v", ran, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Delays between the attempts of something that may fail for a moment, like
+// a publish during a broker hiccup
+type backoff struct {
+	// Delay before the first retry, doubled for each one after it up to max,
+	// or without limit if max is 0
+	initial time.Duration
+	max     time.Duration
+	// Retries after the first attempt, negative to retry until ctx ends
+	retries int
+}
+
+// Run op until it succeeds, the retries are used up or ctx ends, waiting
+// between attempts. what describes op for the logs, like "publishing", and
+// attrs are key/value pairs logged with it. Returns op's last error.
+func retry(ctx context.Context, b backoff, what string, op func() error, attrs ...any) error {
+	delay := b.initial
+	for attempt := 0; ; attempt++ {
+		err := op()
+		// An open circuit fails every attempt until it closes again
+		if err == nil || errors.Is(err, errCircuitOpen) || (b.retries >= 0 && attempt >= b.retries) {
+			return err
+		}
+		logMessage(WARN, "Error "+what+", retrying", append(attrs, "delay", delay, "error", err)...)
+		if !sleepContext(ctx, delay) {
+			return err
+		}
+		if delay *= 2; b.max > 0 && delay > b.max {
+			delay = b.max
+		}
+	}
+}
+
+// Wait for d, returns false if ctx ended first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Publishes being retried in the background, by topic
+var publishRetrying = make(map[string]*publishRetry)
+var publishRetryingMu sync.Mutex
+
+type publishRetry struct {
+	cancel context.CancelFunc
+}
+
+// Held while publishing to a topic, so a retry can't publish an older
+// message after a newer one
+var publishTopicLocks = newKeyedMutex()
+
+// Tracks whether any publish of a request was left to background retries
+type retryScheduledKey struct{}
+
+// Track the publishes made with the returned context. A publish that fails
+// but is retried in the background then reports success and sets the flag,
+// so the request can be answered with 202 Accepted rather than an error
+// the sender would retry too.
+func trackRetries(ctx context.Context) (context.Context, *atomic.Bool) {
+	scheduled := new(atomic.Bool)
+	return context.WithValue(ctx, retryScheduledKey{}, scheduled), scheduled
+}
+
+// Publish a message once, giving up when ctx ends, and if that fails keep
+// retrying it in the background with b's delays so a momentary broker hiccup
+// doesn't lose it. The caller isn't held up by the retries. A newer message
+// for the same topic replaces one still being retried. Returns the first
+// attempt's error, or nil if ctx tracks retries.
+func publishRetried(ctx context.Context, b backoff, topic string, qos byte, retained bool, payload []byte) error {
+	unlock := publishTopicLocks.lock(topic)
+	defer unlock()
+	stopPublishRetry(topic)
+	err := publishContext(ctx, topic, qos, retained, payload)
+	if err == nil || b.retries == 0 || errors.Is(err, errCircuitOpen) {
+		return err
+	}
+
+	// Registered before the topic is unlocked, so the next message for it
+	// stops the retry
+	retryCtx, cancel := context.WithCancel(context.Background())
+	pending := &publishRetry{cancel: cancel}
+	publishRetryingMu.Lock()
+	publishRetrying[topic] = pending
+	publishRetryingMu.Unlock()
+	logMessage(WARN, "Error publishing, retrying in the background", "topic", topic, "error", err)
+
+	go func() {
+		defer recoverGoroutine("publish retry")
+		if !sleepContext(retryCtx, b.initial) {
+			return
+		}
+		next := backoff{initial: b.initial * 2, max: b.max, retries: b.retries - 1}
+		if b.retries < 0 {
+			next.retries = b.retries
+		}
+		err := retry(retryCtx, next, "publishing", func() error {
+			unlock := publishTopicLocks.lock(topic)
+			defer unlock()
+			// A newer message replaced this one
+			if retryCtx.Err() != nil {
+				return nil
+			}
+			return publish(topic, qos, retained, payload)
+		}, "topic", topic)
+		if err != nil && retryCtx.Err() == nil {
+			logMessage(ERROR, "Giving up publishing", "topic", topic, "error", err)
+		}
+		publishRetryingMu.Lock()
+		if publishRetrying[topic] == pending {
+			delete(publishRetrying, topic)
+		}
+		publishRetryingMu.Unlock()
+		cancel()
+	}()
+	if scheduled, ok := ctx.Value(retryScheduledKey{}).(*atomic.Bool); ok {
+		scheduled.Store(true)
+		return nil
+	}
+	return err
+}
+
+// Stop retrying a topic's last failed publish
+func stopPublishRetry(topic string) {
+	publishRetryingMu.Lock()
+	defer publishRetryingMu.Unlock()
+	if pending, ok := publishRetrying[topic]; ok {
+		pending.cancel()
+		delete(publishRetrying, topic)
+	}
+}
+
+// Publish a message, giving up once ctx ends. The publish itself carries on
+// then, its result is dropped.
+func publishContext(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	if ctx.Done() == nil {
+		return publish(topic, qos, retained, payload)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- publish(topic, qos, retained, payload)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	failure := errors.New("broker hiccup")
+	tests := []struct {
+		name     string
+		retries  int
+		failures int
+		err      error
+		attempts int
+	}{
+		{"succeeds right away", 2, 0, nil, 1},
+		{"succeeds on a retry", 2, 2, nil, 3},
+		{"retries used up", 2, 5, failure, 3},
+		{"no retries", 0, 5, failure, 1},
+		{"circuit open", 2, 5, errCircuitOpen, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := retry(context.Background(), backoff{initial: time.Millisecond, retries: tt.retries}, "testing", func() error {
+				attempts++
+				if attempts > tt.failures {
+					return nil
+				}
+				if tt.err != nil {
+					return tt.err
+				}
+				return failure
+			})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("made %d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWhenContextEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := retry(ctx, backoff{initial: time.Hour, retries: -1}, "testing", func() error {
+		attempts++
+		cancel()
+		return errors.New("broker hiccup")
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("got error %v after %d attempts, want an error after 1", err, attempts)
+	}
+}
+
+func TestDispatchAcceptsStatesRetriedInTheBackground(t *testing.T) {
+	savedBrokers, savedCircuit, savedDelay, savedBackoff := brokers, publishCircuit, discoveryDelay, publishRetryBackoff
+	defer func() {
+		brokers, publishCircuit, discoveryDelay, publishRetryBackoff = savedBrokers, savedCircuit, savedDelay, savedBackoff
+	}()
+	publishCircuit = &circuitBreaker{threshold: 100, cooldown: time.Minute}
+	discoveryDelay = 0
+	publishRetryBackoff = time.Millisecond
+
+	body := []byte(`{"call":"active","control":"zoom","mute":"active","record":"active","share":"active","video":"active"}`)
+	tests := []struct {
+		name   string
+		topic  string
+		fail   map[string]bool
+		status int
+	}{
+		{name: "published", topic: "published", status: http.StatusOK},
+		{name: "retried in the background", topic: "retried", fail: map[string]bool{"mutedeck2mqtt/retried": true}, status: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			brokers = []*broker{{name: "primary", client: &fakeClient{fail: tt.fail}, connected: true}}
+			defer stopPublishRetry("mutedeck2mqtt/" + tt.topic)
+
+			r := httptest.NewRequest(http.MethodPost, "/?topic="+tt.topic, nil)
+			update, problems := newStateUpdate(r, body, false)
+			if len(problems) > 0 {
+				t.Fatalf("got problems %q", problems)
+			}
+			status, err := dispatchUpdate(r, update)
+			if status != tt.status || err != nil {
+				t.Errorf("got status %d with error %v, want %d", status, err, tt.status)
+			}
+		})
+	}
+}
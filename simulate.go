@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Take synthetic states on <simulateTopic>/<topic> and handle them like
+// webhooks, to test automations without joining a meeting
+var simulate = false
+var simulateTopic = "mutedeck2mqtt/bridge/simulate"
+
+// Handle a simulated state like a webhook for the topic it was sent to
+func onSimulate(client mqtt.Client, msg mqtt.Message) {
+	// Don't hold up the MQTT client while publishing
+	go handleSimulate(msg.Topic(), msg.Payload())
+}
+
+func handleSimulate(mqttTopic string, payload []byte) {
+	defer recoverGoroutine("simulate handler")
+	topic := strings.TrimPrefix(mqttTopic, simulateTopic+"/")
+	r, err := http.NewRequest(http.MethodPost, "/webhook/"+topic, bytes.NewReader(payload))
+	if err != nil {
+		logMessage(WARN, "Ignoring simulated state", "topic", topic, "error", err)
+		return
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, "simulate-"+hex.EncodeToString(id)))
+	r.RemoteAddr = "mqtt"
+
+	update, problems := newStateUpdate(r, payload, false)
+	recordReceived(r, update, problems)
+	if len(problems) > 0 {
+		logRequest(r, WARN, "Rejected simulated state", "topic", topic, "problems", strings.Join(problems, "; "))
+		return
+	}
+	logRequest(r, INFO, "Simulating state", "topic", update.topic)
+	if _, err := dispatchUpdate(r, update); err != nil {
+		logRequest(r, ERROR, "Error publishing simulated state", "topic", update.topic, "error", err)
+	}
+}
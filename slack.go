@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Slack user token of each topic whose user's status follows its calls
+var slackTokens = make(map[string]string)
+
+// Status set while a call is active, overridden per topic with
+// SLACK_STATUS_TEXT_<TOPIC> and SLACK_STATUS_EMOJI_<TOPIC>, and whether Do
+// Not Disturb is turned on for at most slackDNDMinutes
+var slackStatusText = "In a meeting"
+var slackStatusEmoji = ":spiral_calendar_pad:"
+var slackDND = false
+var slackDNDMinutes = 120
+
+// Topics whose Slack status was set for a call, or cleared after it, so a
+// change that failed is made again with the next state
+var slackInCall = make(map[string]bool)
+var slackInCallMu sync.Mutex
+
+// Status changes queued per topic so they're made in order
+var slackQueue *deviceQueue
+
+// Slack Web API
+var slackAPI = "https://slack.com/api/"
+
+// Parse a comma separated list of topic=token Slack user tokens
+func parseSlackTokens(list string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		topic, token, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected topic=token, got %q", entry)
+		}
+		topic = strings.TrimSpace(topic)
+		if err := validateTopicLevel("topic", topic); err != nil {
+			return nil, err
+		}
+		if token = strings.TrimSpace(token); token == "" {
+			return nil, fmt.Errorf("missing token for %s", topic)
+		}
+		tokens[topic] = token
+	}
+	return tokens, nil
+}
+
+// Set the Slack status of a topic's user when its call becomes active, and
+// clear it when the call ends
+func syncSlackStatus(topic string, state MuteDeckState) {
+	token, ok := slackTokens[topic]
+	if !ok || state.Omit["call"] || state.Call == "" || state.Call == unknownValue {
+		return
+	}
+
+	active := state.Call == "active"
+	if slackStatusIs(topic, active) {
+		return
+	}
+	if !slackQueue.enqueue(topic, func() { updateSlackStatus(topic, token, active) }) {
+		logMessage(WARN, "Slack queue is full, dropping status change", "topic", topic)
+	}
+}
+
+// Whether a topic's Slack status was last set for active
+func slackStatusIs(topic string, active bool) bool {
+	slackInCallMu.Lock()
+	defer slackInCallMu.Unlock()
+	inCall, ok := slackInCall[topic]
+	return ok && inCall == active
+}
+
+// Set or clear a user's Slack status and Do Not Disturb. A status is only
+// cleared if it's still the one the bridge set, so a status the user set
+// during the call is kept.
+func updateSlackStatus(topic string, token string, active bool) {
+	// An earlier queued change may have made this one already
+	if slackStatusIs(topic, active) {
+		return
+	}
+
+	text := topicEnv("SLACK_STATUS_TEXT", topic, slackStatusText)
+	emoji := topicEnv("SLACK_STATUS_EMOJI", topic, slackStatusEmoji)
+	keep := false
+	if !active {
+		var current struct {
+			Profile struct {
+				StatusText  string `json:"status_text"`
+				StatusEmoji string `json:"status_emoji"`
+			} `json:"profile"`
+		}
+		if err := callSlack(token, "users.profile.get", "application/x-www-form-urlencoded", nil, &current); err != nil {
+			logMessage(ERROR, "Error getting Slack status", "topic", topic, "error", err)
+			recordRecentError("slack", topic, err.Error())
+			return
+		}
+		keep = current.Profile.StatusText != text || current.Profile.StatusEmoji != emoji
+	}
+
+	if keep {
+		logMessage(DEBUG, "Slack status was changed during the call, keeping it", "topic", topic)
+	} else {
+		profile := map[string]interface{}{"status_text": "", "status_emoji": "", "status_expiration": 0}
+		if active {
+			profile["status_text"] = text
+			profile["status_emoji"] = emoji
+		}
+		body, err := json.Marshal(map[string]interface{}{"profile": profile})
+		if err != nil {
+			logMessage(ERROR, "Error marshaling Slack status", "error", err)
+			return
+		}
+		if err := callSlack(token, "users.profile.set", "application/json; charset=utf-8", body, nil); err != nil {
+			logMessage(ERROR, "Error setting Slack status", "topic", topic, "error", err)
+			recordRecentError("slack", topic, err.Error())
+			return
+		}
+	}
+	slackInCallMu.Lock()
+	slackInCall[topic] = active
+	slackInCallMu.Unlock()
+
+	if !slackDND {
+		logMessage(DEBUG, "Updated Slack status", "topic", topic)
+		return
+	}
+	var err error
+	if active {
+		form := url.Values{"num_minutes": {fmt.Sprint(slackDNDMinutes)}}
+		err = callSlack(token, "dnd.setSnooze", "application/x-www-form-urlencoded", []byte(form.Encode()), nil)
+	} else {
+		err = callSlack(token, "dnd.endSnooze", "application/x-www-form-urlencoded", nil, nil)
+		// The user may have ended it already
+		if err != nil && strings.Contains(err.Error(), "snooze_not_active") {
+			err = nil
+		}
+	}
+	if err != nil {
+		logMessage(ERROR, "Error updating Slack Do Not Disturb", "topic", topic, "error", err)
+		recordRecentError("slack", topic, err.Error())
+		return
+	}
+	logMessage(DEBUG, "Updated Slack status", "topic", topic)
+}
+
+// Call a Slack Web API method, decoding its response into result unless it's
+// nil. Slack answers errors with 200 and ok false.
+func callSlack(token string, method string, contentType string, body []byte, result interface{}) error {
+	req, err := newOutboundRequest(http.MethodPost, slackAPI+method, contentType, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return sendOutbound(req, serviceTimeout, func(resp *http.Response) error {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		var status struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return fmt.Errorf("slack %s returned invalid JSON: %v", method, err)
+		}
+		if !status.OK {
+			return fmt.Errorf("slack %s failed: %s", method, status.Error)
+		}
+		if result != nil {
+			return json.Unmarshal(data, result)
+		}
+		return nil
+	})
+}
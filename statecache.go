@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The last state published to a topic, and the device topic it came from
+type lastState struct {
+	topic     string
+	payload   []byte
+	published time.Time
+}
+
+var lastStates = make(map[string]lastState)
+var lastStatesMu sync.Mutex
+
+// Check whether a state differs from the last one published to the topic, or
+// the last publish is older than the refresh interval
+func stateChanged(topic string, payload []byte, refresh time.Duration) bool {
+	lastStatesMu.Lock()
+	defer lastStatesMu.Unlock()
+
+	last, ok := lastStates[topic]
+	if !ok || !bytes.Equal(last.payload, payload) {
+		return true
+	}
+	return refresh > 0 && time.Since(last.published) >= refresh
+}
+
+// Remember a state that was published to the topic for a device
+func rememberState(topic string, device string, payload []byte) {
+	lastStatesMu.Lock()
+	defer lastStatesMu.Unlock()
+	lastStates[topic] = lastState{topic: device, payload: payload, published: time.Now()}
+}
+
+// Forget the last state published to the topic
+func forgetState(topic string) {
+	lastStatesMu.Lock()
+	defer lastStatesMu.Unlock()
+	delete(lastStates, topic)
+}
+
+// A device's last state as served by /state
+type StatePayload struct {
+	Topic       string          `json:"topic"`
+	StateTopic  string          `json:"state_topic"`
+	State       json.RawMessage `json:"state"`
+	LastUpdated string          `json:"last_updated"`
+}
+
+// Serve the last state published for every device with GET /state, or for
+// one device with GET /state/{topic}, so scripts can poll the bridge instead
+// of subscribing to the broker
+func handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := strings.Trim(strings.TrimPrefix(r.URL.Path, "/state"), "/")
+
+	lastStatesMu.Lock()
+	states := make([]StatePayload, 0, len(lastStates))
+	for stateTopic, last := range lastStates {
+		if topic != "" && topic != last.topic {
+			continue
+		}
+		states = append(states, StatePayload{
+			Topic:       last.topic,
+			StateTopic:  stateTopic,
+			State:       json.RawMessage(last.payload),
+			LastUpdated: last.published.UTC().Format(time.RFC3339),
+		})
+	}
+	lastStatesMu.Unlock()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].StateTopic < states[j].StateTopic
+	})
+
+	if topic == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states)
+		return
+	}
+	if len(states) == 0 {
+		http.Error(w, "No state published for "+topic, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// A device posting under several prefixes has a state for each, the
+	// first one is served
+	json.NewEncoder(w).Encode(states[0])
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsD server metrics are sent to over UDP, empty to not send any. With
+// dogStatsD set metrics are tagged in the DogStatsD format, plain StatsD has
+// no tags.
+var statsdAddress = ""
+var statsdPrefix = "mutedeck2mqtt."
+var dogStatsD = false
+var statsdTags []string
+
+// Metrics waiting to be sent
+var statsdQueue = make(chan string, 1024)
+
+// Closed to stop the sender, which closes statsdDone once it sent the last
+// metrics
+var statsdStop = make(chan struct{})
+var statsdDone = make(chan struct{})
+
+// How often queued metrics are sent, and the largest packet sent. Packets
+// stay below the usual network MTU so they aren't fragmented.
+var statsdFlushInterval = time.Second
+
+const statsdPacketSize = 1432
+
+// Count an event. tags are key:value pairs, only sent with DogStatsD.
+func statsdCount(name string, value int64, tags ...string) {
+	sendMetric(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Record how long an operation took
+func statsdTiming(name string, d time.Duration, tags ...string) {
+	sendMetric(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+func sendMetric(name string, value string, kind string, tags []string) {
+	if statsdAddress == "" {
+		return
+	}
+	line := fmt.Sprintf("%s%s:%s|%s", statsdPrefix, name, value, kind)
+	if dogStatsD {
+		all := append(append([]string(nil), statsdTags...), tags...)
+		if len(all) > 0 {
+			line += "|#" + strings.Join(all, ",")
+		}
+	}
+
+	select {
+	case statsdQueue <- line:
+	default:
+		// Drop metrics rather than block when the sender falls behind
+	}
+}
+
+// Build a DogStatsD tag, replacing the characters the format reserves
+func statsdTag(key string, value string) string {
+	return key + ":" + strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace(value)
+}
+
+// Parse STATSD_TAGS, a comma separated list of key:value tags
+func parseStatsdTags(list string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		if strings.ContainsAny(tag, "|#") {
+			return nil, fmt.Errorf("tag %q must not contain | or #", tag)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// Send queued metrics, several per packet, until statsdStop is closed
+func runStatsdSender(conn net.Conn, done chan<- struct{}) {
+	defer close(done)
+	defer conn.Close()
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+
+	var packet []byte
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := conn.Write(packet); err != nil {
+			logMessage(DEBUG, "Error sending metrics", "address", statsdAddress, "error", err)
+		}
+		packet = packet[:0]
+	}
+	add := func(line string) {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdPacketSize {
+			flush()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	for {
+		select {
+		case line := <-statsdQueue:
+			add(line)
+		case <-ticker.C:
+			flush()
+		case <-statsdStop:
+			// Send what's still queued
+			for {
+				select {
+				case line := <-statsdQueue:
+					add(line)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Count webhooks by status and time them
+func measureRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if statsdAddress == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		status := statsdTag("status", strconv.Itoa(recorder.status))
+		statsdCount("webhook.requests", 1, status)
+		statsdTiming("webhook.duration", time.Since(start), status)
+	})
+}
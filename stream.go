@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// A client following published states, and the topic it follows, empty for
+// all. send is closed when the client falls behind.
+type stateSubscriber struct {
+	topic string
+	send  chan []byte
+}
+
+var stateSubscribers = make(map[*stateSubscriber]bool)
+
+// Last message sent for each topic, sent to subscribers when they connect
+var streamedStates = make(map[string][]byte)
+var stateSubscribersMu sync.Mutex
+
+// A state as streamed to WebSocket and event stream clients
+type StateMessage struct {
+	Topic      string                 `json:"topic"`
+	StateTopic string                 `json:"state_topic"`
+	State      map[string]interface{} `json:"state"`
+}
+
+// Follow published states, starting with the last state of every device
+func subscribeStates(topic string) *stateSubscriber {
+	subscriber := &stateSubscriber{topic: topic, send: make(chan []byte, 16)}
+
+	stateSubscribersMu.Lock()
+	defer stateSubscribersMu.Unlock()
+	for t, message := range streamedStates {
+		if topic == "" || topic == t {
+			select {
+			case subscriber.send <- message:
+			default:
+			}
+		}
+	}
+	stateSubscribers[subscriber] = true
+	return subscriber
+}
+
+// Stop following published states
+func unsubscribeStates(subscriber *stateSubscriber) {
+	stateSubscribersMu.Lock()
+	defer stateSubscribersMu.Unlock()
+	if stateSubscribers[subscriber] {
+		delete(stateSubscribers, subscriber)
+		close(subscriber.send)
+	}
+}
+
+// Send a published state to the subscribers following its topic.
+// Subscribers that fall behind are dropped rather than holding up
+// publishing.
+func broadcastState(u stateUpdate) {
+	if !websocketEnabled && !eventsEnabled {
+		return
+	}
+
+	message, err := json.Marshal(StateMessage{Topic: u.topic, StateTopic: u.fullTopic, State: u.state.fields()})
+	if err != nil {
+		logMessage(ERROR, "Error marshaling state message", "error", err)
+		return
+	}
+
+	stateSubscribersMu.Lock()
+	defer stateSubscribersMu.Unlock()
+	streamedStates[u.topic] = message
+	for subscriber := range stateSubscribers {
+		if subscriber.topic != "" && subscriber.topic != u.topic {
+			continue
+		}
+		select {
+		case subscriber.send <- message:
+		default:
+			delete(stateSubscribers, subscriber)
+			close(subscriber.send)
+		}
+	}
+}
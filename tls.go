@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Build the TLS configuration for the HTTP server from the environment.
+// Returns nil if TLS is not enabled.
+func loadTLSConfig() (*tls.Config, error) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+
+	selfSigned := false
+	if selfSignedStr := os.Getenv("TLS_SELF_SIGNED"); selfSignedStr != "" {
+		var err error
+		selfSigned, err = strconv.ParseBool(selfSignedStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS_SELF_SIGNED: %v", err)
+		}
+	}
+
+	var cert tls.Certificate
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		var err error
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS certificate: %v", err)
+		}
+		logMessage(INFO, "Using TLS certificate", "path", certFile)
+	case selfSigned:
+		var err error
+		cert, err = generateSelfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("error generating self-signed certificate: %v", err)
+		}
+		logMessage(INFO, "Using a generated self-signed TLS certificate")
+	default:
+		if os.Getenv("TLS_CLIENT_CA_FILE") != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE or TLS_SELF_SIGNED")
+		}
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// Verify client certificates against the configured CA. A certificate is
+	// only required by requireClientCert, so health probes without one can
+	// still connect.
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in TLS client CA: %s", caFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		logMessage(INFO, "Requiring client certificates", "ca", caFile)
+	}
+
+	return tlsConfig, nil
+}
+
+// Generate a self-signed certificate valid for the local hostname, localhost
+// and the loopback addresses
+func generateSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		dnsNames = append(dnsNames, hostname)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "mutedeck2mqtt"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
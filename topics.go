@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest value accepted for a single topic level
+const maxTopicLevelLength = 64
+
+// Check that a value from a request is safe to use as one MQTT topic level.
+// Wildcards and separators would let a request publish to other topics, so
+// they are rejected rather than stripped.
+func validateTopicLevel(name string, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s must not be empty", name)
+	}
+	if len(value) > maxTopicLevelLength {
+		return fmt.Errorf("%s must be at most %d bytes long", name, maxTopicLevelLength)
+	}
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%s must be valid UTF-8", name)
+	}
+	if value[0] == '$' {
+		return fmt.Errorf("%s must not start with $", name)
+	}
+	for _, c := range value {
+		switch {
+		case c == '/' || c == '+' || c == '#':
+			return fmt.Errorf("%s must not contain %q", name, c)
+		case unicode.IsControl(c):
+			return fmt.Errorf("%s must not contain control characters", name)
+		}
+	}
+	return nil
+}
+
+// Topics the bridge publishes or listens on itself. A device's state topic
+// may not be one of them, nor sit above or below one, or a webhook could
+// announce the bridge offline or send it commands through the device's
+// derived topics.
+func reservedTopics() []string {
+	return []string{
+		defaultPrefix + "/bridge",
+		defaultPrefix + "/command",
+		availabilityTopic,
+		bridgeCommandTopic,
+		bridgeStateTopic,
+		commandTopicRoot,
+		simulateTopic,
+		anyoneInMeetingTopic,
+	}
+}
+
+// The reserved topic a state topic overlaps, empty if there's none
+func reservedTopicOverlap(stateTopic string) string {
+	for _, reserved := range reservedTopics() {
+		if stateTopic == reserved || strings.HasPrefix(stateTopic, reserved+"/") || strings.HasPrefix(reserved, stateTopic+"/") {
+			return reserved
+		}
+	}
+	return ""
+}
+
+// Prefixes requests may publish under, a "*" entry allows any prefix
+var allowedPrefixes = map[string]bool{defaultPrefix: true}
+
+// Parse a comma separated list of allowed prefixes
+func parseAllowedPrefixes(list string) (map[string]bool, error) {
+	prefixes := make(map[string]bool)
+	for _, prefix := range strings.Split(list, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		if prefix != "*" {
+			if err := validateTopicLevel("prefix", prefix); err != nil {
+				return nil, err
+			}
+		}
+		prefixes[prefix] = true
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no prefixes given")
+	}
+	return prefixes, nil
+}
+
+// Check whether a request may publish under a prefix. Discovery prefixes are
+// never allowed so requests can't overwrite other devices' discovery configs.
+func prefixAllowed(prefix string) bool {
+	if prefix == discovery_prefix || allowedDiscoveryPrefixes[prefix] {
+		return false
+	}
+	return allowedPrefixes["*"] || allowedPrefixes[prefix]
+}
+
+// Discovery prefixes requests may pick besides the configured one, for
+// bridges serving several Home Assistant installations
+var allowedDiscoveryPrefixes = map[string]bool{}
+
+// Parse a comma separated list of discovery prefixes
+func parseDiscoveryPrefixes(list string) (map[string]bool, error) {
+	prefixes := make(map[string]bool)
+	for _, prefix := range strings.Split(list, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix == "" {
+			continue
+		}
+		if err := validateTopicLevel("discovery prefix", prefix); err != nil {
+			return nil, err
+		}
+		prefixes[prefix] = true
+	}
+	return prefixes, nil
+}
+
+// Check whether a request may announce devices under a discovery prefix
+func discoveryPrefixAllowed(prefix string) bool {
+	return prefix == discovery_prefix || allowedDiscoveryPrefixes[prefix]
+}
+
+// Build the topic of the discovery config of the device published under a
+// topic, from its device ID
+func deviceDiscoveryTopic(prefix string, topic string) string {
+	return fmt.Sprintf("%s/%s/%s_%s/config", prefix, "device", object_id, deviceIDOf(topic))
+}
+
+// Get the discovery prefix a device's discovery topic is under
+func discoveryPrefixOf(discoveryTopic string) string {
+	if i := strings.LastIndex(discoveryTopic, "/device/"); i >= 0 {
+		return discoveryTopic[:i]
+	}
+	return discovery_prefix
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReservedTopicOverlap(t *testing.T) {
+	tests := []struct {
+		stateTopic string
+		reserved   bool
+	}{
+		{"mutedeck2mqtt/laptop", false},
+		{"mutedeck2mqtt/bridges", false},
+		{"office/bridge", false},
+		{"mutedeck2mqtt/bridge", true},
+		{"mutedeck2mqtt/command", true},
+		{"mutedeck2mqtt/bridge/availability", true},
+		{"mutedeck2mqtt/command/laptop/mute", true},
+		// Its availability topic would be the bridge's
+		{"mutedeck2mqtt", true},
+	}
+	for _, tt := range tests {
+		if got := reservedTopicOverlap(tt.stateTopic); (got != "") != tt.reserved {
+			t.Errorf("%s overlaps %q, want reserved %v", tt.stateTopic, got, tt.reserved)
+		}
+	}
+}
+
+func TestWebhookCantUseBridgeTopics(t *testing.T) {
+	body := []byte(`{"call":"active","control":"zoom","mute":"active","record":"active","share":"active","video":"active"}`)
+	for _, topic := range []string{"bridge", "command", "laptop"} {
+		r := httptest.NewRequest(http.MethodPost, "/?topic="+topic, nil)
+		_, problems := newStateUpdate(r, body, false)
+		if reserved := topic != "laptop"; (len(problems) > 0) != reserved {
+			t.Errorf("topic %s got problems %q, want reserved %v", topic, problems, reserved)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counters of a single device's topic
+type topicStats struct {
+	received      int64
+	rejected      int64
+	published     int64
+	publishErrors int64
+	lastReceived  time.Time
+	lastPublished time.Time
+	lastError     string
+	// Discovery topic of the device once a state was published
+	discoveryTopic string
+}
+
+var topicStatsByTopic = make(map[string]*topicStats)
+var topicStatsMu sync.Mutex
+
+// Most topics counted, the one updated longest ago is dropped for a new one
+const maxTopicStats = 256
+
+// Get the counters of a topic, creating them if needed. Must be called with
+// topicStatsMu held.
+func statsFor(topic string) *topicStats {
+	s, ok := topicStatsByTopic[topic]
+	if !ok {
+		if len(topicStatsByTopic) >= maxTopicStats {
+			evictTopicStats()
+		}
+		s = &topicStats{}
+		topicStatsByTopic[topic] = s
+	}
+	return s
+}
+
+// Drop the counters of the topic updated longest ago. Must be called with
+// topicStatsMu held.
+func evictTopicStats() {
+	oldest := ""
+	var oldestTime time.Time
+	for topic, s := range topicStatsByTopic {
+		updated := s.lastReceived
+		if s.lastPublished.After(updated) {
+			updated = s.lastPublished
+		}
+		if oldest == "" || updated.Before(oldestTime) {
+			oldest, oldestTime = topic, updated
+		}
+	}
+	delete(topicStatsByTopic, oldest)
+}
+
+// Record a state received for a topic, and whether it was rejected
+func recordReceived(r *http.Request, u stateUpdate, problems []string) {
+	topic := u.topic
+	if topic == "" {
+		// Invalid states don't get as far as naming their topic, and only
+		// valid topics are counted so clients can't fill the stats with
+		// made-up ones
+		_, topic = getTopic(r, MuteDeckState{}, false)
+		if validateTopicLevel("topic", topic) != nil {
+			topic = ""
+		}
+	}
+	if topic == "" {
+		statsdCount("states.received", 1)
+		if len(problems) > 0 {
+			statsdCount("states.rejected", 1)
+		}
+		return
+	}
+
+	tag := statsdTag("topic", topic)
+	statsdCount("states.received", 1, tag)
+	if len(problems) > 0 {
+		statsdCount("states.rejected", 1, tag)
+		recordRecentError("validation", topic, strings.Join(problems, "; "))
+	}
+
+	topicStatsMu.Lock()
+	defer topicStatsMu.Unlock()
+	s := statsFor(topic)
+	s.received++
+	s.lastReceived = time.Now()
+	if len(problems) > 0 {
+		s.rejected++
+		s.lastError = problems[0]
+	}
+}
+
+// Record the outcome of publishing a state
+func recordPublished(u stateUpdate, err error) {
+	if err != nil {
+		statsdCount("states.publish_errors", 1, statsdTag("topic", u.topic))
+	} else {
+		statsdCount("states.published", 1, statsdTag("topic", u.topic))
+	}
+
+	topicStatsMu.Lock()
+	defer topicStatsMu.Unlock()
+	s := statsFor(u.topic)
+	s.discoveryTopic = u.discoveryTopic
+	if err != nil {
+		s.publishErrors++
+		s.lastError = err.Error()
+		return
+	}
+	s.published++
+	s.lastPublished = time.Now()
+}
+
+// Statistics of a topic as served by /stats
+type TopicStatsPayload struct {
+	Received       int64  `json:"received"`
+	Rejected       int64  `json:"rejected"`
+	Published      int64  `json:"published"`
+	PublishErrors  int64  `json:"publish_errors"`
+	LastReceived   string `json:"last_received,omitempty"`
+	LastPublished  string `json:"last_published,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	Discovered     bool   `json:"discovered"`
+	DiscoveryTopic string `json:"discovery_topic,omitempty"`
+}
+
+// Serve the statistics of every topic with GET /stats, to see whether a
+// machine is sending webhooks and what happened to them
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mu.Lock()
+	announced := make(map[string]bool, len(discoveryTopics))
+	for topic, sent := range discoveryTopics {
+		announced[topic] = sent
+	}
+	mu.Unlock()
+
+	topicStatsMu.Lock()
+	payload := make(map[string]TopicStatsPayload, len(topicStatsByTopic))
+	for topic, s := range topicStatsByTopic {
+		p := TopicStatsPayload{
+			Received:       s.received,
+			Rejected:       s.rejected,
+			Published:      s.published,
+			PublishErrors:  s.publishErrors,
+			LastError:      s.lastError,
+			Discovered:     s.discoveryTopic != "" && announced[s.discoveryTopic],
+			DiscoveryTopic: s.discoveryTopic,
+		}
+		if !s.lastReceived.IsZero() {
+			p.LastReceived = s.lastReceived.UTC().Format(time.RFC3339)
+		}
+		if !s.lastPublished.IsZero() {
+			p.LastPublished = s.lastPublished.UTC().Format(time.RFC3339)
+		}
+		payload[topic] = p
+	}
+	topicStatsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Whether webhooks are traced. The OTLP/HTTP exporter is configured with the
+// standard OTEL_EXPORTER_OTLP_* variables.
+var tracing = false
+var serviceName = "mutedeck2mqtt"
+
+// Provider batching and exporting spans, nil without tracing
+var tracerProvider *sdktrace.TracerProvider
+
+// Creates the bridge's spans. Without tracing it's OpenTelemetry's no-op
+// tracer.
+var tracer = otel.Tracer("mutedeck2mqtt")
+
+// Span kinds
+const (
+	spanKindInternal = trace.SpanKindInternal
+	spanKindServer   = trace.SpanKindServer
+	spanKindProducer = trace.SpanKindProducer
+)
+
+// A timed operation of a trace
+type span struct {
+	trace.Span
+}
+
+// Start exporting spans with OTLP over HTTP
+func setupTracing(ctx context.Context) error {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName), attribute.String("service.version", version)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = tracerProvider.Tracer("mutedeck2mqtt", trace.WithInstrumentationVersion(version))
+	return nil
+}
+
+// Export the spans still queued and stop tracing. Spans ending afterwards are
+// dropped.
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logMessage(WARN, "Error exporting the last spans", "error", err)
+	}
+}
+
+// Start a span as a child of the context's span, or of a new trace. attrs
+// are key/value pairs.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...string) (context.Context, span) {
+	ctx, s := tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.SetAttributes(attribute.String(attrs[i], attrs[i+1]))
+	}
+	return ctx, span{s}
+}
+
+func (s span) setAttr(key string, value string) {
+	s.SetAttributes(attribute.String(key, value))
+}
+
+// End the span, marking it failed if err isn't nil
+func (s span) finish(err error) {
+	if err != nil {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.End()
+}
+
+// ID of the trace a context belongs to, empty if it isn't traced
+func traceIDFrom(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Trace a webhook as a server span, continuing an incoming traceparent
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, s := startSpan(ctx, fmt.Sprintf("%s /webhook", r.Method), spanKindServer,
+			"http.request.method", r.Method, "url.path", r.URL.Path, "client.address", getClientIP(r))
+		if id := getRequestID(r); id != "" {
+			s.setAttr("request_id", id)
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		s.setAttr("http.response.status_code", strconv.Itoa(recorder.status))
+		var err error
+		if recorder.status >= 400 {
+			err = fmt.Errorf("%d %s", recorder.status, http.StatusText(recorder.status))
+		}
+		s.finish(err)
+	})
+}
+
+// Publish a message in a span of the request's trace
+func tracedPublish(r *http.Request, topic string, qos byte, retained bool, payload []byte) error {
+	ctx, s := startSpan(r.Context(), "mqtt publish", spanKindProducer, "messaging.destination.name", topic)
+	err := publishOrQueue(ctx, topic, qos, retained, payload)
+	s.finish(err)
+	return err
+}
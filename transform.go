@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Templates reshaping the JSON state, by topic. The "" entry applies to
+// topics without a template of their own.
+var stateTemplates = make(map[string]*template.Template)
+
+// Functions available to state templates
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// Key of a topic's template, the topic as it appears in an environment
+// variable name
+func templateKey(topic string) string {
+	return strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			return c
+		}
+		return '_'
+	}, strings.ToLower(topic))
+}
+
+// Load STATE_TEMPLATE and the per topic STATE_TEMPLATE_<TOPIC> templates
+func loadStateTemplates() error {
+	for _, env := range os.Environ() {
+		name, text, _ := strings.Cut(env, "=")
+		if text == "" {
+			continue
+		}
+
+		var key string
+		switch {
+		case name == "STATE_TEMPLATE":
+		case strings.HasPrefix(name, "STATE_TEMPLATE_"):
+			key = templateKey(strings.TrimPrefix(name, "STATE_TEMPLATE_"))
+		default:
+			continue
+		}
+
+		tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return err
+		}
+		stateTemplates[key] = tmpl
+		logMessage(DEBUG, "Loaded state template", "name", name)
+	}
+	return nil
+}
+
+// Reshape a device's state with its template. Returns nil if the device has
+// no template.
+func transformState(topic string, state MuteDeckState) ([]byte, error) {
+	tmpl, ok := stateTemplates[templateKey(topic)]
+	if !ok {
+		tmpl, ok = stateTemplates[""]
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, state.fields()); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template %s produced invalid JSON: %s", tmpl.Name(), buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
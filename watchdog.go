@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// How often the retained discovery and availability messages are checked,
+// zero to never check them, and how long to wait for the broker to send them
+var watchdogInterval time.Duration
+var watchdogWait = 2 * time.Second
+
+// Check the retained messages on a fixed interval
+func runWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkRetained()
+	}
+}
+
+// A retained message the broker should have
+type retainedMessage struct {
+	payload   []byte
+	discovery bool
+}
+
+// Get the retained messages the broker should have, by topic
+func expectedRetained() map[string]retainedMessage {
+	expected := make(map[string]retainedMessage)
+	expected[availabilityTopic] = retainedMessage{payload: []byte("online")}
+
+	onlineDevicesMu.Lock()
+	for topic, online := range onlineDevices {
+		if online {
+			expected[topic] = retainedMessage{payload: []byte("online")}
+		}
+	}
+	onlineDevicesMu.Unlock()
+
+	// Discovery messages are only retained with DISCOVERY_RETAIN
+	if !discoveryRetain {
+		return expected
+	}
+	mu.Lock()
+	cached := make(map[string]DiscoveryPayloadStruct, len(discoveryMessages))
+	for topic, payload := range discoveryMessages {
+		if discoveryTopics[topic] {
+			cached[topic] = payload
+		}
+	}
+	mu.Unlock()
+	for topic, payload := range bridgeDiscoveryMessage() {
+		cached[topic] = payload
+	}
+	for discoveryTopic, payload := range cached {
+		messages, err := discoveryMessagesFor(discoveryTopic, payload)
+		if err != nil {
+			logMessage(ERROR, "Error marshaling discovery JSON data", "error", err)
+			continue
+		}
+		for topic, data := range messages {
+			expected[topic] = retainedMessage{payload: data, discovery: true}
+		}
+	}
+	return expected
+}
+
+// Subscribe to the retained discovery and availability topics and republish
+// the messages the broker no longer has, e.g. after retained messages were
+// wiped, so Home Assistant doesn't lose the devices
+func checkRetained() {
+	if len(brokers) == 0 || !brokers[0].isConnected() {
+		return
+	}
+	client := brokers[0].client
+
+	expected := expectedRetained()
+	filters := make(map[string]byte, len(expected))
+	topics := make([]string, 0, len(expected))
+	for topic := range expected {
+		filters[topic] = 0
+		topics = append(topics, topic)
+	}
+
+	var seen = make(map[string]bool)
+	var seenMu sync.Mutex
+	token := client.SubscribeMultiple(filters, func(client mqtt.Client, msg mqtt.Message) {
+		if msg.Retained() && len(msg.Payload()) > 0 {
+			seenMu.Lock()
+			seen[msg.Topic()] = true
+			seenMu.Unlock()
+		}
+	})
+	if !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+		logMessage(WARN, "Error subscribing to check retained messages", "error", token.Error())
+		return
+	}
+	// Retained messages are sent right after subscribing
+	time.Sleep(watchdogWait)
+	client.Unsubscribe(topics...)
+
+	seenMu.Lock()
+	defer seenMu.Unlock()
+	for topic, m := range expected {
+		if seen[topic] {
+			continue
+		}
+		logMessage(WARN, "Retained message is missing, republishing it", "topic", topic)
+		var err error
+		if m.discovery {
+			err = publishDiscovery(context.Background(), topic, m.payload)
+		} else {
+			err = publish(topic, 1, true, m.payload)
+		}
+		if err != nil {
+			logMessage(ERROR, "Error republishing retained message", "topic", topic, "error", err)
+		}
+	}
+}
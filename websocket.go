@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Serve published states to WebSocket clients on /ws, and the origins
+// browsers may connect from besides the bridge's own. A "*" entry allows any
+// origin.
+var websocketEnabled = false
+var websocketOrigins = map[string]bool{}
+
+// Whether /ws requires a token. Clients that send no Origin, which browsers
+// always do, are only accepted then, as they can't be told apart otherwise.
+var websocketTokenRequired = false
+
+// How often clients are pinged to keep the connection open and detect
+// clients that went away
+const websocketPingInterval = 30 * time.Second
+
+var websocketUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return websocketTokenRequired
+		}
+		if websocketOrigins["*"] || websocketOrigins[origin] {
+			return true
+		}
+		// Browsers on the bridge's own pages
+		return strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://") == r.Host
+	},
+}
+
+// Stream published states with GET /ws, starting with the last state of
+// every device. ?topic= only streams one device.
+func handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	conn, err := websocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the request
+		logRequest(r, WARN, "Error upgrading to WebSocket", "error", err)
+		return
+	}
+	defer conn.Close()
+	// The server's timeouts are meant for requests, not a long lived stream
+	conn.SetReadDeadline(time.Time{})
+
+	subscriber := subscribeStates(topic)
+	defer unsubscribeStates(subscriber)
+	logRequest(r, DEBUG, "WebSocket client connected")
+
+	// Read until the client goes away, it doesn't send anything else
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(websocketPingInterval)
+	defer ping.Stop()
+	defer logRequest(r, DEBUG, "WebSocket client disconnected")
+	for {
+		select {
+		case message, ok := <-subscriber.send:
+			if !ok {
+				logRequest(r, WARN, "WebSocket client fell behind, disconnecting it")
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
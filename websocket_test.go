@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebsocketCheckOrigin(t *testing.T) {
+	savedOrigins, savedRequired := websocketOrigins, websocketTokenRequired
+	defer func() { websocketOrigins, websocketTokenRequired = savedOrigins, savedRequired }()
+	websocketOrigins = map[string]bool{"http://dashboard.local:3000": true}
+
+	tests := []struct {
+		name          string
+		origin        string
+		tokenRequired bool
+		want          bool
+	}{
+		{name: "bridge's own page", origin: "http://bridge.local:8080", want: true},
+		{name: "allowed origin", origin: "http://dashboard.local:3000", want: true},
+		{name: "other origin", origin: "http://evil.example", want: false},
+		{name: "other origin with a token", origin: "http://evil.example", tokenRequired: true, want: false},
+		{name: "no origin", want: false},
+		{name: "no origin with a token", tokenRequired: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			websocketTokenRequired = tt.tokenRequired
+			r := httptest.NewRequest(http.MethodGet, "http://bridge.local:8080/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := websocketUpgrader.CheckOrigin(r); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}